@@ -1,14 +1,19 @@
 package core
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"sort"
 	"strings"
 	"time"
 )
 
 import (
+	"env"
 	"printer"
 	"reader"
 	"readline"
@@ -28,6 +33,8 @@ func fn_q(a []MalType) (MalType, error) {
 		return true, nil
 	case func([]MalType) (MalType, error):
 		return true, nil
+	case *MultiFn:
+		return true, nil
 	default:
 		return false, nil
 	}
@@ -67,13 +74,6 @@ func time_ms(a []MalType) (MalType, error) {
 }
 
 // Hash Map functions
-func copy_hash_map(hm HashMap) HashMap {
-	new_hm := HashMap{map[string]MalType{}, nil}
-	for k, v := range hm.Val {
-		new_hm.Val[k] = v
-	}
-	return new_hm
-}
 
 func assoc(a []MalType) (MalType, error) {
 	if len(a) < 3 {
@@ -82,34 +82,100 @@ func assoc(a []MalType) (MalType, error) {
 	if len(a)%2 != 1 {
 		return nil, errors.New("assoc requires odd number of arguments")
 	}
+	if vec, ok := a[0].(Vector); ok {
+		return assoc_vector(vec, a[1:])
+	}
+	if Nil_Q(a[0]) {
+		// as on an empty map, e.g. (vary-meta x assoc :k v)
+		return NewArrayMap(List{a[1:], nil})
+	}
+	if am, ok := a[0].(ArrayMap); ok {
+		for i := 1; i < len(a); i += 2 {
+			am = am.Assoc(a[i], a[i+1])
+		}
+		return am, nil
+	}
+	if rec, ok := a[0].(Record); ok {
+		if !rec.Type.IsMap {
+			return nil, errors.New("assoc called on deftype " + rec.Type.Name)
+		}
+		for i := 1; i < len(a); i += 2 {
+			rec = rec.Assoc(a[i], a[i+1])
+		}
+		return rec, nil
+	}
+	if sm, ok := a[0].(SortedMap); ok {
+		var e error
+		for i := 1; i < len(a); i += 2 {
+			if sm, e = sm.Assoc(a[i], a[i+1]); e != nil {
+				return nil, e
+			}
+		}
+		return sm, nil
+	}
 	if !HashMap_Q(a[0]) {
 		return nil, errors.New("assoc called on non-hash map")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
+	new_hm := a[0].(HashMap)
 	for i := 1; i < len(a); i += 2 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("assoc called with non-string key")
-		}
-		new_hm.Val[key.(string)] = a[i+1]
+		new_hm = new_hm.Assoc(a[i], a[i+1])
 	}
 	return new_hm, nil
 }
 
+func assoc_vector(vec Vector, kvs []MalType) (MalType, error) {
+	var e error
+	for i := 0; i < len(kvs); i += 2 {
+		idx, ok := kvs[i].(int)
+		if !ok {
+			return nil, errors.New("assoc called on vector with non-integer index")
+		}
+		if vec, e = vec.AssocN(idx, kvs[i+1]); e != nil {
+			return nil, e
+		}
+	}
+	return vec, nil
+}
+
 func dissoc(a []MalType) (MalType, error) {
 	if len(a) < 2 {
 		return nil, errors.New("dissoc requires at least 3 arguments")
 	}
+	if am, ok := a[0].(ArrayMap); ok {
+		for _, k := range a[1:] {
+			am = am.Dissoc(k)
+		}
+		return am, nil
+	}
+	if rec, ok := a[0].(Record); ok {
+		if !rec.Type.IsMap {
+			return nil, errors.New("dissoc called on deftype " + rec.Type.Name)
+		}
+		var res MalType = rec
+		for _, k := range a[1:] {
+			if rec, ok := res.(Record); ok {
+				res = rec.Dissoc(k)
+			} else {
+				res = res.(ArrayMap).Dissoc(k)
+			}
+		}
+		return res, nil
+	}
+	if sm, ok := a[0].(SortedMap); ok {
+		var e error
+		for _, k := range a[1:] {
+			if sm, e = sm.Dissoc(k); e != nil {
+				return nil, e
+			}
+		}
+		return sm, nil
+	}
 	if !HashMap_Q(a[0]) {
 		return nil, errors.New("dissoc called on non-hash map")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
+	new_hm := a[0].(HashMap)
 	for i := 1; i < len(a); i += 1 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("dissoc called with non-string key")
-		}
-		delete(new_hm.Val, key.(string))
+		new_hm = new_hm.Dissoc(a[i])
 	}
 	return new_hm, nil
 }
@@ -118,55 +184,209 @@ func get(a []MalType) (MalType, error) {
 	if Nil_Q(a[0]) {
 		return nil, nil
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("get called on non-hash map")
+	if SetLike_Q(a[0]) {
+		elem, _, e := SetGet(a[0], a[1])
+		return elem, e
 	}
-	if !String_Q(a[1]) {
-		return nil, errors.New("get called with non-string key")
+	if t, ok := a[0].(*Transient); ok {
+		val, _, e := t.Get(a[1])
+		return val, e
+	}
+	if !Map_Q(a[0]) && !Record_Q(a[0]) {
+		return nil, errors.New("get called on non-hash map")
 	}
-	return a[0].(HashMap).Val[a[1].(string)], nil
+	val, _, e := MapGet(a[0], a[1])
+	return val, e
 }
 
 func contains_Q(hm MalType, key MalType) (MalType, error) {
 	if Nil_Q(hm) {
 		return false, nil
 	}
-	if !HashMap_Q(hm) {
-		return nil, errors.New("get called on non-hash map")
+	if SetLike_Q(hm) {
+		_, ok, e := SetGet(hm, key)
+		return ok, e
 	}
-	if !String_Q(key) {
-		return nil, errors.New("get called with non-string key")
+	if !Map_Q(hm) && !Record_Q(hm) {
+		return nil, errors.New("get called on non-hash map")
 	}
-	_, ok := hm.(HashMap).Val[key.(string)]
-	return ok, nil
+	_, ok, e := MapGet(hm, key)
+	return ok, e
 }
 
 func keys(a []MalType) (MalType, error) {
-	if !HashMap_Q(a[0]) {
+	entries, e := MapEntries(a[0])
+	if e != nil {
 		return nil, errors.New("keys called on non-hash map")
 	}
 	slc := []MalType{}
-	for k, _ := range a[0].(HashMap).Val {
-		slc = append(slc, k)
+	for _, ent := range entries {
+		slc = append(slc, ent.Key)
 	}
 	return List{slc, nil}, nil
 }
 
 func vals(a []MalType) (MalType, error) {
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("keys called on non-hash map")
+	entries, e := MapEntries(a[0])
+	if e != nil {
+		return nil, errors.New("vals called on non-hash map")
 	}
 	slc := []MalType{}
-	for _, v := range a[0].(HashMap).Val {
-		slc = append(slc, v)
+	for _, ent := range entries {
+		slc = append(slc, ent.Val)
 	}
 	return List{slc, nil}, nil
 }
 
+// Set functions
+func set(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
+	case Set:
+		obj.Meta = nil
+		return obj, nil
+	case nil:
+		return NewSet(), nil
+	}
+	slc, e := GetSlice(a[0])
+	if e != nil {
+		return nil, errors.New("set: expects a sequence")
+	}
+	return NewSet(slc...), nil
+}
+
+func disj(a []MalType) (MalType, error) {
+	if len(a) < 1 {
+		return nil, errors.New("disj requires at least 1 argument")
+	}
+	if a[0] == nil {
+		return nil, nil
+	}
+	if ss, ok := a[0].(SortedSet); ok {
+		var e error
+		for _, x := range a[1:] {
+			if ss, e = ss.Disj(x); e != nil {
+				return nil, e
+			}
+		}
+		return ss, nil
+	}
+	set, ok := a[0].(Set)
+	if !ok {
+		return nil, errors.New("disj called on non-set")
+	}
+	for _, x := range a[1:] {
+		set = set.Disj(x)
+	}
+	return set, nil
+}
+
+// get_sets checks the arguments are sets, sorted or not, and returns
+// their elements. The results of union and the like are of the type
+// of the first set.
+func get_sets(name string, a []MalType) ([][]MalType, error) {
+	elems := make([][]MalType, 0, len(a))
+	for _, obj := range a {
+		if !SetLike_Q(obj) {
+			return nil, errors.New(name + " called on non-set")
+		}
+		slc, _ := GetSlice(obj)
+		elems = append(elems, slc)
+	}
+	return elems, nil
+}
+
+// in_set is true when x is an element of set
+func in_set(set MalType, x MalType) (bool, error) {
+	_, ok, e := SetGet(set, x)
+	return ok, e
+}
+
+func union(a []MalType) (MalType, error) {
+	elems, e := get_sets("union", a)
+	if e != nil {
+		return nil, e
+	}
+	if len(elems) == 0 {
+		return NewSet(), nil
+	}
+	res := a[0]
+	for _, slc := range elems[1:] {
+		if len(slc) == 0 {
+			continue
+		}
+		if res, e = conj(append([]MalType{res}, slc...)); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+func intersection(a []MalType) (MalType, error) {
+	elems, e := get_sets("intersection", a)
+	if e != nil {
+		return nil, e
+	}
+	if len(elems) == 0 {
+		return nil, errors.New("intersection requires at least 1 argument")
+	}
+	res := a[0]
+	for _, x := range elems[0] {
+		for _, set := range a[1:] {
+			ok, e := in_set(set, x)
+			if e != nil {
+				return nil, e
+			}
+			if !ok {
+				if res, e = disj([]MalType{res, x}); e != nil {
+					return nil, e
+				}
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func difference(a []MalType) (MalType, error) {
+	elems, e := get_sets("difference", a)
+	if e != nil {
+		return nil, e
+	}
+	if len(elems) == 0 {
+		return nil, errors.New("difference requires at least 1 argument")
+	}
+	res := a[0]
+	for _, slc := range elems[1:] {
+		if res, e = disj(append([]MalType{res}, slc...)); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+func subset_Q(a []MalType) (MalType, error) {
+	elems, e := get_sets("subset?", a)
+	if e != nil {
+		return nil, e
+	}
+	if len(elems[0]) > len(elems[1]) {
+		return false, nil
+	}
+	for _, x := range elems[0] {
+		if ok, e := in_set(a[1], x); e != nil || !ok {
+			return false, e
+		}
+	}
+	return true, nil
+}
+
 // Sequence functions
 
 func cons(a []MalType) (MalType, error) {
 	val := a[0]
+	if LazySeq_Q(a[1]) {
+		return NewCons(val, a[1]), nil
+	}
 	lst, e := GetSlice(a[1])
 	if e != nil {
 		return nil, e
@@ -178,6 +398,9 @@ func concat(a []MalType) (MalType, error) {
 	if len(a) == 0 {
 		return List{}, nil
 	}
+	if any_lazy(a) {
+		return lazy_concat(a), nil
+	}
 	slc1, e := GetSlice(a[0])
 	if e != nil {
 		return nil, e
@@ -197,18 +420,45 @@ func vec(a []MalType) (MalType, error) {
 	case Vector:
 		return obj, nil
 	case List:
-		return Vector{obj.Val, nil}, nil
+		return NewVector(obj.Val...), nil
 	default:
-		return nil, errors.New("vec: expects a sequence")
+		slc, e := GetSlice(obj)
+		if e != nil {
+			return nil, errors.New("vec: expects a sequence")
+		}
+		return NewVector(slc...), nil
 	}
 }
 
 func nth(a []MalType) (MalType, error) {
+	idx := a[1].(int)
+	if vec, ok := a[0].(Vector); ok {
+		if val, ok := vec.Nth(idx); ok {
+			return val, nil
+		}
+		return nil, errors.New("nth: index out of range")
+	}
+	if ls, ok := a[0].(LazySeq); ok {
+		var seq MalType = ls
+		for i := 0; i <= idx; i++ {
+			first, rest, ok, e := Uncons(seq)
+			if e != nil {
+				return nil, e
+			}
+			if !ok {
+				break
+			}
+			if i == idx {
+				return first, nil
+			}
+			seq = rest
+		}
+		return nil, errors.New("nth: index out of range")
+	}
 	slc, e := GetSlice(a[0])
 	if e != nil {
 		return nil, e
 	}
-	idx := a[1].(int)
 	if idx < len(slc) {
 		return slc[idx], nil
 	} else {
@@ -223,6 +473,13 @@ func first(a []MalType) (MalType, error) {
 	if a[0] == nil {
 		return nil, nil
 	}
+	if vec, ok := a[0].(Vector); ok {
+		val, _ := vec.Nth(0)
+		return val, nil
+	}
+	if ls, ok := a[0].(LazySeq); ok {
+		return ls.First()
+	}
 	slc, e := GetSlice(a[0])
 	if e != nil {
 		return nil, e
@@ -237,6 +494,12 @@ func rest(a []MalType) (MalType, error) {
 	if a[0] == nil {
 		return List{}, nil
 	}
+	switch seq := a[0].(type) {
+	case LazySeq:
+		return seq.Rest()
+	case Vector:
+		return seq.SeqFrom(1), nil
+	}
 	slc, e := GetSlice(a[0])
 	if e != nil {
 		return nil, e
@@ -252,7 +515,21 @@ func empty_Q(a []MalType) (MalType, error) {
 	case List:
 		return len(obj.Val) == 0, nil
 	case Vector:
-		return len(obj.Val) == 0, nil
+		return obj.Count() == 0, nil
+	case Set:
+		return obj.Count() == 0, nil
+	case HashMap:
+		return obj.Count() == 0, nil
+	case ArrayMap:
+		return obj.Count() == 0, nil
+	case Record:
+		return obj.Count() == 0, nil
+	case SortedMap:
+		return obj.Count() == 0, nil
+	case SortedSet:
+		return obj.Count() == 0, nil
+	case LazySeq:
+		return obj.Empty()
 	case nil:
 		return true, nil
 	default:
@@ -265,9 +542,24 @@ func count(a []MalType) (MalType, error) {
 	case List:
 		return len(obj.Val), nil
 	case Vector:
-		return len(obj.Val), nil
-	case map[string]MalType:
-		return len(obj), nil
+		return obj.Count(), nil
+	case HashMap:
+		return obj.Count(), nil
+	case ArrayMap:
+		return obj.Count(), nil
+	case Record:
+		return obj.Count(), nil
+	case Set:
+		return obj.Count(), nil
+	case SortedMap:
+		return obj.Count(), nil
+	case SortedSet:
+		return obj.Count(), nil
+	case *Transient:
+		return obj.Count()
+	case LazySeq:
+		slc, e := GetSlice(obj)
+		return len(slc), e
 	case nil:
 		return 0, nil
 	default:
@@ -292,21 +584,13 @@ func apply(a []MalType) (MalType, error) {
 	return Apply(f, args)
 }
 
+// map, filter, take and drop always return a lazy sequence: nothing
+// is computed until the result is looked at
 func do_map(a []MalType) (MalType, error) {
-	f := a[0]
-	results := []MalType{}
-	args, e := GetSlice(a[1])
-	if e != nil {
-		return nil, e
-	}
-	for _, arg := range args {
-		res, e := Apply(f, []MalType{arg})
-		results = append(results, res)
-		if e != nil {
-			return nil, e
-		}
+	if len(a) < 2 {
+		return nil, errors.New("map requires at least 2 arguments")
 	}
-	return List{results, nil}, nil
+	return lazy_map(a[0], a[1:]), nil
 }
 
 func conj(a []MalType) (MalType, error) {
@@ -321,25 +605,71 @@ func conj(a []MalType) (MalType, error) {
 		}
 		return List{append(new_slc, seq.Val...), nil}, nil
 	case Vector:
-		new_slc := seq.Val
+		return seq.Conj(a[1:]...), nil
+	case LazySeq:
+		var res MalType = seq
+		for _, x := range a[1:] {
+			res = NewCons(x, res)
+		}
+		return res, nil
+	case Set:
 		for _, x := range a[1:] {
-			new_slc = append(new_slc, x)
+			seq = seq.Conj(x)
 		}
-		return Vector{new_slc, nil}, nil
+		return seq, nil
+	case SortedSet:
+		var e error
+		for _, x := range a[1:] {
+			if seq, e = seq.Conj(x); e != nil {
+				return nil, e
+			}
+		}
+		return seq, nil
+	case HashMap, ArrayMap, SortedMap, Record:
+		kvs := []MalType{seq}
+		for _, x := range a[1:] {
+			kv, e := GetSlice(x)
+			if e != nil || len(kv) != 2 {
+				return nil, errors.New("conj on a map requires [key value] pairs")
+			}
+			kvs = append(kvs, kv...)
+		}
+		return assoc(kvs)
 	}
+	return nil, errors.New("conj requires a collection")
+}
 
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("dissoc called on non-hash map")
+func peek(a []MalType) (MalType, error) {
+	switch seq := a[0].(type) {
+	case List:
+		if len(seq.Val) == 0 {
+			return nil, nil
+		}
+		return seq.Val[0], nil
+	case Vector:
+		val, _ := seq.Nth(seq.Count() - 1)
+		return val, nil
+	case nil:
+		return nil, nil
+	default:
+		return nil, errors.New("peek called on non-list/vector")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
-	for i := 1; i < len(a); i += 1 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("dissoc called with non-string key")
+}
+
+func pop(a []MalType) (MalType, error) {
+	switch seq := a[0].(type) {
+	case List:
+		if len(seq.Val) == 0 {
+			return nil, errors.New("can't pop empty list")
 		}
-		delete(new_hm.Val, key.(string))
+		return List{seq.Val[1:], seq.Meta}, nil
+	case Vector:
+		return seq.Pop()
+	case nil:
+		return nil, nil
+	default:
+		return nil, errors.New("pop called on non-list/vector")
 	}
-	return new_hm, nil
 }
 
 func seq(a []MalType) (MalType, error) {
@@ -353,10 +683,36 @@ func seq(a []MalType) (MalType, error) {
 		}
 		return arg, nil
 	case Vector:
-		if len(arg.Val) == 0 {
+		if arg.Count() == 0 {
+			return nil, nil
+		}
+		return List{arg.Slice(), nil}, nil
+	case LazySeq:
+		empty, e := arg.Empty()
+		if e != nil || empty {
+			return nil, e
+		}
+		return arg, nil
+	case Set:
+		if arg.Count() == 0 {
+			return nil, nil
+		}
+		return List{arg.Elements(), nil}, nil
+	case SortedSet:
+		if arg.Count() == 0 {
+			return nil, nil
+		}
+		return List{arg.Elements(), nil}, nil
+	case ArrayMap, SortedMap, Record:
+		entries, _ := MapEntries(arg)
+		if len(entries) == 0 {
 			return nil, nil
 		}
-		return List{arg.Val, nil}, nil
+		new_slc := []MalType{}
+		for _, ent := range entries {
+			new_slc = append(new_slc, NewVector(ent.Key, ent.Val))
+		}
+		return List{new_slc, nil}, nil
 	case string:
 		if len(arg) == 0 {
 			return nil, nil
@@ -370,76 +726,1793 @@ func seq(a []MalType) (MalType, error) {
 	return nil, errors.New("seq requires string or list or vector or nil")
 }
 
-// Metadata functions
-func with_meta(a []MalType) (MalType, error) {
-	obj := a[0]
-	m := a[1]
-	switch tobj := obj.(type) {
-	case List:
-		return List{tobj.Val, m}, nil
-	case Vector:
-		return Vector{tobj.Val, m}, nil
-	case HashMap:
-		return HashMap{tobj.Val, m}, nil
-	case Func:
-		return Func{tobj.Fn, m}, nil
-	case MalFunc:
-		fn := tobj
-		fn.Meta = m
-		return fn, nil
-	default:
-		return nil, errors.New("with-meta not supported on type")
+// Lazy sequence functions
+
+// any_lazy is true when one of seqs is a lazy sequence, which may be
+// infinite: concat is lazy then, and eager otherwise
+func any_lazy(seqs []MalType) bool {
+	for _, seq := range seqs {
+		if LazySeq_Q(seq) {
+			return true
+		}
 	}
+	return false
 }
 
-func meta(a []MalType) (MalType, error) {
-	obj := a[0]
-	switch tobj := obj.(type) {
-	case List:
-		return tobj.Meta, nil
-	case Vector:
-		return tobj.Meta, nil
-	case HashMap:
-		return tobj.Meta, nil
-	case Func:
-		return tobj.Meta, nil
-	case MalFunc:
-		return tobj.Meta, nil
-	default:
-		return nil, errors.New("meta not supported on type")
+// convert vectors and sets once so that Uncons is cheap
+func to_seq(coll MalType) (MalType, error) {
+	switch coll.(type) {
+	case nil, List, LazySeq:
+		return coll, nil
+	}
+	slc, e := GetSlice(coll)
+	if e != nil {
+		return nil, e
 	}
+	return List{slc, nil}, nil
 }
 
-// Atom functions
-func deref(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("deref called with non-atom")
+func truthy(obj MalType) bool {
+	return !(obj == nil || obj == false)
+}
+
+func lazy_seq(a []MalType) (MalType, error) {
+	f := a[0]
+	return NewLazySeq(func() (MalType, error) {
+		return Apply(f, []MalType{})
+	}), nil
+}
+
+func lazy_concat(seqs []MalType) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		if len(seqs) == 0 {
+			return nil, nil
+		}
+		first, rest, ok, e := Uncons(seqs[0])
+		if e != nil {
+			return nil, e
+		}
+		if !ok {
+			return lazy_concat(seqs[1:]), nil
+		}
+		new_seqs := append([]MalType{rest}, seqs[1:]...)
+		return NewCons(first, lazy_concat(new_seqs)), nil
+	})
+}
+
+func lazy_map(f MalType, seqs []MalType) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		args := make([]MalType, len(seqs))
+		rests := make([]MalType, len(seqs))
+		for i, seq := range seqs {
+			seq, e := to_seq(seq)
+			if e != nil {
+				return nil, e
+			}
+			first, rest, ok, e := Uncons(seq)
+			if e != nil || !ok {
+				return nil, e
+			}
+			args[i] = first
+			rests[i] = rest
+		}
+		res, e := Apply(f, args)
+		if e != nil {
+			return nil, e
+		}
+		return NewCons(res, lazy_map(f, rests)), nil
+	})
+}
+
+func lazy_filter(pred MalType, seq MalType) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		seq, e := to_seq(seq)
+		if e != nil {
+			return nil, e
+		}
+		for {
+			first, rest, ok, e := Uncons(seq)
+			if e != nil || !ok {
+				return nil, e
+			}
+			res, e := Apply(pred, []MalType{first})
+			if e != nil {
+				return nil, e
+			}
+			if truthy(res) {
+				return NewCons(first, lazy_filter(pred, rest)), nil
+			}
+			seq = rest
+		}
+	})
+}
+
+func lazy_take(n int, seq MalType) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		if n <= 0 {
+			return nil, nil
+		}
+		seq, e := to_seq(seq)
+		if e != nil {
+			return nil, e
+		}
+		first, rest, ok, e := Uncons(seq)
+		if e != nil || !ok {
+			return nil, e
+		}
+		return NewCons(first, lazy_take(n-1, rest)), nil
+	})
+}
+
+func lazy_drop(n int, seq MalType) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		seq, e := to_seq(seq)
+		if e != nil {
+			return nil, e
+		}
+		for i := 0; i < n; i++ {
+			_, rest, ok, e := Uncons(seq)
+			if e != nil || !ok {
+				return nil, e
+			}
+			seq = rest
+		}
+		return seq, nil
+	})
+}
+
+func filter(a []MalType) (MalType, error) {
+	return lazy_filter(a[0], a[1]), nil
+}
+
+func take(a []MalType) (MalType, error) {
+	n, ok := a[0].(int)
+	if !ok {
+		return nil, errors.New("take: expects a number")
 	}
-	return a[0].(*Atom).Val, nil
+	return lazy_take(n, a[1]), nil
 }
 
-func reset_BANG(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("reset! called with non-atom")
+func drop(a []MalType) (MalType, error) {
+	n, ok := a[0].(int)
+	if !ok {
+		return nil, errors.New("drop: expects a number")
 	}
-	a[0].(*Atom).Set(a[1])
-	return a[1], nil
+	return lazy_drop(n, a[1]), nil
 }
 
-func swap_BANG(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("swap! called with non-atom")
+func iterate_seq(f MalType, x MalType) MalType {
+	return NewCons(x, NewLazySeq(func() (MalType, error) {
+		y, e := Apply(f, []MalType{x})
+		if e != nil {
+			return nil, e
+		}
+		return iterate_seq(f, y), nil
+	}))
+}
+
+func repeat_seq(x MalType) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		return NewCons(x, repeat_seq(x)), nil
+	})
+}
+
+func repeat(a []MalType) (MalType, error) {
+	switch len(a) {
+	case 1:
+		return repeat_seq(a[0]), nil
+	case 2:
+		n, ok := a[0].(int)
+		if !ok {
+			return nil, errors.New("repeat: expects a number")
+		}
+		return lazy_take(n, repeat_seq(a[1])), nil
+	default:
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 1 or 2)", len(a))
 	}
-	atm := a[0].(*Atom)
-	args := []MalType{atm.Val}
-	f := a[1]
-	args = append(args, a[2:]...)
-	res, e := Apply(f, args)
+}
+
+func cycle_seq(slc []MalType, i int) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		return NewCons(slc[i], cycle_seq(slc, (i+1)%len(slc))), nil
+	})
+}
+
+func cycle(a []MalType) (MalType, error) {
+	slc, e := GetSlice(a[0])
 	if e != nil {
 		return nil, e
 	}
-	atm.Set(res)
-	return res, nil
+	if len(slc) == 0 {
+		return List{}, nil
+	}
+	return cycle_seq(slc, 0), nil
+}
+
+func range_seq(start int, end int, step int, infinite bool) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		if !infinite && ((step >= 0 && start >= end) || (step < 0 && start <= end)) {
+			return nil, nil
+		}
+		return NewCons(start, range_seq(start+step, end, step, infinite)), nil
+	})
+}
+
+func do_range(a []MalType) (MalType, error) {
+	nums := []int{}
+	for _, x := range a {
+		n, ok := x.(int)
+		if !ok {
+			return nil, errors.New("range: expects numbers")
+		}
+		nums = append(nums, n)
+	}
+	switch len(nums) {
+	case 0:
+		return range_seq(0, 0, 1, true), nil
+	case 1:
+		return range_seq(0, nums[0], 1, false), nil
+	case 2:
+		return range_seq(nums[0], nums[1], 1, false), nil
+	case 3:
+		if nums[2] == 0 && nums[0] < nums[1] {
+			return repeat_seq(nums[0]), nil
+		}
+		return range_seq(nums[0], nums[1], nums[2], false), nil
+	default:
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 0 to 3)", len(a))
+	}
+}
+
+// line_seq reads a file lazily, closing it after the last line
+func line_seq_from(f *os.File, rdr *bufio.Reader) MalType {
+	return NewLazySeq(func() (MalType, error) {
+		line, e := rdr.ReadString('\n')
+		if e != nil && (e != io.EOF || line == "") {
+			f.Close()
+			if e == io.EOF {
+				return nil, nil
+			}
+			return nil, e
+		}
+		return NewCons(strings.TrimSuffix(line, "\n"), line_seq_from(f, rdr)), nil
+	})
+}
+
+func line_seq(a []MalType) (MalType, error) {
+	f, e := os.Open(a[0].(string))
+	if e != nil {
+		return nil, e
+	}
+	return line_seq_from(f, bufio.NewReader(f)), nil
+}
+
+func doall(a []MalType) (MalType, error) {
+	if ls, ok := a[0].(LazySeq); ok {
+		if _, e := GetSlice(ls); e != nil {
+			return nil, e
+		}
+	}
+	return a[0], nil
+}
+
+// Ordering functions
+func compare(a []MalType) (MalType, error) {
+	return Compare(a[0], a[1])
+}
+
+// ordered makes <, <= and the like from a test on the result of
+// Compare, so they order any values compare does
+func ordered(test func(int) bool) func([]MalType) (MalType, error) {
+	return func(a []MalType) (MalType, error) {
+		c, e := Compare(a[0], a[1])
+		if e != nil {
+			return nil, e
+		}
+		return test(c), nil
+	}
+}
+
+// sort_slice is a stable sort that stops at the first comparator error
+func sort_slice(slc []MalType, keys []MalType, cmp MalType) error {
+	var err error
+	idx := make([]int, len(slc))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		c, e := CompareWith(cmp, keys[idx[i]], keys[idx[j]])
+		if e != nil {
+			err = e
+		}
+		return c < 0
+	})
+	if err != nil {
+		return err
+	}
+	sorted := make([]MalType, len(slc))
+	for i, j := range idx {
+		sorted[i] = slc[j]
+	}
+	copy(slc, sorted)
+	return nil
+}
+
+func do_sort(a []MalType) (MalType, error) {
+	var cmp MalType
+	switch len(a) {
+	case 1:
+	case 2:
+		cmp = a[0]
+	default:
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 1 or 2)", len(a))
+	}
+	coll := a[len(a)-1]
+	if coll == nil {
+		return List{}, nil
+	}
+	slc, e := GetSlice(coll)
+	if e != nil {
+		return nil, errors.New("sort: expects a sequence")
+	}
+	slc = append([]MalType{}, slc...)
+	if e := sort_slice(slc, slc, cmp); e != nil {
+		return nil, e
+	}
+	return List{slc, nil}, nil
+}
+
+func sort_by(a []MalType) (MalType, error) {
+	var cmp MalType
+	switch len(a) {
+	case 2:
+	case 3:
+		cmp = a[1]
+	default:
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 2 or 3)", len(a))
+	}
+	coll := a[len(a)-1]
+	if coll == nil {
+		return List{}, nil
+	}
+	slc, e := GetSlice(coll)
+	if e != nil {
+		return nil, errors.New("sort-by: expects a sequence")
+	}
+	slc = append([]MalType{}, slc...)
+	keys := make([]MalType, len(slc))
+	for i, x := range slc {
+		if keys[i], e = Apply(a[0], []MalType{x}); e != nil {
+			return nil, e
+		}
+	}
+	if e := sort_slice(slc, keys, cmp); e != nil {
+		return nil, e
+	}
+	return List{slc, nil}, nil
+}
+
+// extreme_key returns the last x for which (f x) is least when sign
+// is 1, or greatest when sign is -1
+func extreme_key(a []MalType, sign int) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New("min-key/max-key require at least 2 arguments")
+	}
+	best := a[1]
+	best_key, e := Apply(a[0], []MalType{best})
+	if e != nil {
+		return nil, e
+	}
+	for _, x := range a[2:] {
+		key, e := Apply(a[0], []MalType{x})
+		if e != nil {
+			return nil, e
+		}
+		c, e := Compare(key, best_key)
+		if e != nil {
+			return nil, e
+		}
+		if sign*c <= 0 {
+			best, best_key = x, key
+		}
+	}
+	return best, nil
+}
+
+// Sorted collection functions
+func sorted_map(cmp MalType, kvs []MalType) (MalType, error) {
+	if len(kvs)%2 != 0 {
+		return nil, errors.New("sorted-map requires an even number of arguments")
+	}
+	sm := NewSortedMap(cmp)
+	var e error
+	for i := 0; i < len(kvs); i += 2 {
+		if sm, e = sm.Assoc(kvs[i], kvs[i+1]); e != nil {
+			return nil, e
+		}
+	}
+	return sm, nil
+}
+
+func sorted_map_by(a []MalType) (MalType, error) {
+	if len(a) < 1 {
+		return nil, errors.New("sorted-map-by requires a comparator")
+	}
+	return sorted_map(a[0], a[1:])
+}
+
+func sorted_set(cmp MalType, xs []MalType) (MalType, error) {
+	ss := NewSortedSet(cmp)
+	var e error
+	for _, x := range xs {
+		if ss, e = ss.Conj(x); e != nil {
+			return nil, e
+		}
+	}
+	return ss, nil
+}
+
+func sorted_set_by(a []MalType) (MalType, error) {
+	if len(a) < 1 {
+		return nil, errors.New("sorted-set-by requires a comparator")
+	}
+	return sorted_set(a[0], a[1:])
+}
+
+// subseq and rsubseq take either a test and a key, or a start test
+// and key and an end test and key. As in Clojure a test such as < or
+// >= is applied to the comparison of each key with the bound and 0.
+func subseq(name string, a []MalType, ascending bool) (MalType, error) {
+	if len(a) != 3 && len(a) != 5 {
+		return nil, errors.New(name + " requires 3 or 5 arguments")
+	}
+	var cmp MalType
+	var walk func(MalType, bool, bool, func(MapEntry) bool) error
+	var item func(MapEntry) MalType
+	switch sc := a[0].(type) {
+	case SortedMap:
+		cmp, walk = sc.Cmp, sc.Walk
+		item = func(ent MapEntry) MalType { return NewVector(ent.Key, ent.Val) }
+	case SortedSet:
+		cmp, walk = sc.Cmp(), sc.Walk
+		item = func(ent MapEntry) MalType { return ent.Key }
+	default:
+		return nil, errors.New(name + " called on non-sorted collection")
+	}
+
+	var err error
+	include := func(test MalType, bound MalType, key MalType) bool {
+		c, e := CompareWith(cmp, key, bound)
+		if e == nil {
+			var res MalType
+			res, e = Apply(test, []MalType{c, 0})
+			if e == nil {
+				return truthy(res)
+			}
+		}
+		err = e
+		return false
+	}
+
+	// walk from the start bound, skipping keys that fail the start
+	// test and stopping at the first key that fails the end test
+	var from, start_test, end_test, end_key MalType
+	has_from := false
+	if len(a) == 5 {
+		if ascending {
+			from, start_test, end_test, end_key = a[2], a[1], a[3], a[4]
+		} else {
+			from, start_test, end_test, end_key = a[4], a[3], a[1], a[2]
+		}
+		has_from = true
+	} else {
+		res, e := Apply(a[1], []MalType{1, 0})
+		if e != nil {
+			return nil, e
+		}
+		// a lower bound like > starts an ascending walk, an upper
+		// bound like < starts a descending one
+		if truthy(res) == ascending {
+			from, start_test, has_from = a[2], a[1], true
+		} else {
+			end_test, end_key = a[1], a[2]
+		}
+	}
+
+	slc := []MalType{}
+	e := walk(from, has_from, ascending, func(ent MapEntry) bool {
+		if start_test != nil && !include(start_test, from, ent.Key) {
+			return err == nil
+		}
+		if end_test != nil && !include(end_test, end_key, ent.Key) {
+			return false
+		}
+		slc = append(slc, item(ent))
+		return true
+	})
+	if e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(slc) == 0 {
+		return nil, nil
+	}
+	return List{slc, nil}, nil
+}
+
+// Record functions
+func map_Q(obj MalType) bool {
+	if rec, ok := obj.(Record); ok {
+		return rec.Type.IsMap
+	}
+	return Map_Q(obj)
+}
+
+func field_keywords(fields MalType) ([]MalType, error) {
+	slc, e := GetSlice(fields)
+	if e != nil {
+		return nil, errors.New("record fields must be a vector")
+	}
+	kws := make([]MalType, 0, len(slc))
+	for _, f := range slc {
+		switch tf := f.(type) {
+		case Symbol:
+			kw, _ := NewKeyword(tf.Val)
+			kws = append(kws, kw)
+		case string:
+			if !Keyword_Q(tf) {
+				return nil, errors.New("record fields must be symbols or keywords")
+			}
+			kws = append(kws, tf)
+		default:
+			return nil, errors.New("record fields must be symbols or keywords")
+		}
+	}
+	return kws, nil
+}
+
+// record_constructor registers a record type and returns its
+// positional constructor
+func record_constructor(a []MalType) (MalType, error) {
+	name, ok := a[0].(string)
+	if !ok {
+		return nil, errors.New("record type name must be a string")
+	}
+	fields, e := field_keywords(a[1])
+	if e != nil {
+		return nil, e
+	}
+	rt, e := DefRecordType(name, fields, truthy(a[2]))
+	if e != nil {
+		return nil, e
+	}
+	return Func{func(args []MalType) (MalType, error) {
+		return NewRecord(rt, args)
+	}, nil}, nil
+}
+
+// map_record_constructor returns a constructor taking a map for the
+// registered record type. Missing fields are nil.
+func map_record_constructor(a []MalType) (MalType, error) {
+	name, _ := a[0].(string)
+	rt, ok := LookupRecordType(name)
+	if !ok {
+		return nil, errors.New("no record type named " + name)
+	}
+	return Func{func(args []MalType) (MalType, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("wrong number of arguments (%d instead of 1)", len(args))
+		}
+		entries, e := MapEntries(args[0])
+		if e != nil {
+			return nil, errors.New("map->" + rt.Name + " requires a map")
+		}
+		rec, _ := NewRecord(rt, make([]MalType, len(rt.Fields)))
+		for _, ent := range entries {
+			rec = rec.Assoc(ent.Key, ent.Val)
+		}
+		return rec, nil
+	}, nil}, nil
+}
+
+// Protocol functions
+func protocol(a []MalType) (MalType, error) {
+	name, ok := a[0].(string)
+	if !ok {
+		return nil, errors.New("protocol name must be a string")
+	}
+	syms, e := GetSlice(a[1])
+	if e != nil {
+		return nil, errors.New("protocol methods must be a list")
+	}
+	methods := []string{}
+	for _, sym := range syms {
+		if !Symbol_Q(sym) {
+			return nil, errors.New("protocol method names must be symbols")
+		}
+		methods = append(methods, sym.(Symbol).Val)
+	}
+	return NewProtocol(name, methods), nil
+}
+
+func protocol_method(a []MalType) (MalType, error) {
+	p, ok := a[0].(*Protocol)
+	if !ok {
+		return nil, errors.New("protocol-method* called on non-protocol")
+	}
+	name, ok := a[1].(string)
+	if !ok || !p.HasMethod(name) {
+		return nil, errors.New("protocol-method*: no such method")
+	}
+	return p.Method(name), nil
+}
+
+// extend-type* and extend-protocol* take their specs flattened:
+// protocols (or type names) each followed by ("method" fn) pairs
+func method_spec(obj MalType) (string, MalType, bool) {
+	lst, ok := obj.(List)
+	if !ok || len(lst.Val) != 2 {
+		return "", nil, false
+	}
+	name, ok := lst.Val[0].(string)
+	return name, lst.Val[1], ok
+}
+
+func type_name(obj MalType) (string, error) {
+	switch tobj := obj.(type) {
+	case nil:
+		return "Nil", nil
+	case Symbol:
+		return tobj.Val, nil
+	case string:
+		return tobj, nil
+	}
+	return "", errors.New("type names must be symbols")
+}
+
+func extend(p *Protocol, tname string, specs []MalType) ([]MalType, error) {
+	fns := map[string]MalType{}
+	for len(specs) > 0 {
+		name, f, ok := method_spec(specs[0])
+		if !ok {
+			break
+		}
+		fns[name] = f
+		specs = specs[1:]
+	}
+	return specs, p.Extend(tname, fns)
+}
+
+func extend_type(a []MalType) (MalType, error) {
+	if len(a) < 1 {
+		return nil, errors.New("extend-type requires a type")
+	}
+	tname, e := type_name(a[0])
+	if e != nil {
+		return nil, e
+	}
+	for specs := a[1:]; len(specs) > 0; {
+		p, ok := specs[0].(*Protocol)
+		if !ok {
+			return nil, errors.New("extend-type: expected a protocol")
+		}
+		if specs, e = extend(p, tname, specs[1:]); e != nil {
+			return nil, e
+		}
+	}
+	return nil, nil
+}
+
+func extend_protocol(a []MalType) (MalType, error) {
+	if len(a) < 1 {
+		return nil, errors.New("extend-protocol requires a protocol")
+	}
+	p, ok := a[0].(*Protocol)
+	if !ok {
+		return nil, errors.New("extend-protocol: expected a protocol")
+	}
+	for specs := a[1:]; len(specs) > 0; {
+		tname, e := type_name(specs[0])
+		if e != nil {
+			return nil, e
+		}
+		if specs, e = extend(p, tname, specs[1:]); e != nil {
+			return nil, e
+		}
+	}
+	return nil, nil
+}
+
+func satisfies_Q(a []MalType) (MalType, error) {
+	p, ok := a[0].(*Protocol)
+	if !ok {
+		return nil, errors.New("satisfies? called on non-protocol")
+	}
+	return p.Satisfies(a[1]), nil
+}
+
+// Multimethod functions
+func multi_fn(a []MalType) (MalType, error) {
+	name, ok := a[0].(string)
+	if !ok {
+		return nil, errors.New("multimethod name must be a string")
+	}
+	mf := &MultiFn{Name: name, Dispatch: a[1], DefaultVal: a[2]}
+	mf.Fn = func(args []MalType) (MalType, error) {
+		dv, e := Apply(mf.Dispatch, args)
+		if e != nil {
+			return nil, e
+		}
+		f, matches := mf.FindMethod(dv)
+		if matches != nil {
+			return nil, fmt.Errorf("multiple methods in multimethod %s match dispatch value %s: %s, and neither is preferred",
+				mf.Name, printer.Pr_str(dv, true), printer.Pr_list(matches, true, "", "", " and "))
+		}
+		if f == nil {
+			return nil, fmt.Errorf("no method in multimethod %s for dispatch value %s",
+				mf.Name, printer.Pr_str(dv, true))
+		}
+		return Apply(f, args)
+	}
+	return mf, nil
+}
+
+func get_multi_fn(name string, obj MalType) (*MultiFn, error) {
+	mf, ok := obj.(*MultiFn)
+	if !ok {
+		return nil, errors.New(name + " called on non-multimethod")
+	}
+	return mf, nil
+}
+
+func add_method(a []MalType) (MalType, error) {
+	mf, e := get_multi_fn("defmethod", a[0])
+	if e != nil {
+		return nil, e
+	}
+	mf.AddMethod(a[1], a[2])
+	return mf, nil
+}
+
+func remove_method(a []MalType) (MalType, error) {
+	mf, e := get_multi_fn("remove-method", a[0])
+	if e != nil {
+		return nil, e
+	}
+	mf.RemoveMethod(a[1])
+	return mf, nil
+}
+
+func methods(a []MalType) (MalType, error) {
+	mf, e := get_multi_fn("methods", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return mf.Methods(), nil
+}
+
+func derive(a []MalType) (MalType, error) {
+	return nil, Derive(a[0], a[1])
+}
+
+// Transient functions
+func get_transient(name string, a []MalType) (*Transient, error) {
+	if len(a) < 1 {
+		return nil, errors.New(name + " requires a transient")
+	}
+	t, ok := a[0].(*Transient)
+	if !ok {
+		return nil, errors.New(name + " called on non-transient")
+	}
+	return t, nil
+}
+
+func conj_BANG(a []MalType) (MalType, error) {
+	t, e := get_transient("conj!", a)
+	if e != nil {
+		return nil, e
+	}
+	for _, x := range a[1:] {
+		if e := t.Conj(x); e != nil {
+			return nil, e
+		}
+	}
+	return t, nil
+}
+
+func assoc_BANG(a []MalType) (MalType, error) {
+	if len(a)%2 != 1 {
+		return nil, errors.New("assoc! requires an odd number of arguments")
+	}
+	t, e := get_transient("assoc!", a)
+	if e != nil {
+		return nil, e
+	}
+	for i := 1; i < len(a); i += 2 {
+		if e := t.Assoc(a[i], a[i+1]); e != nil {
+			return nil, e
+		}
+	}
+	return t, nil
+}
+
+func dissoc_BANG(a []MalType) (MalType, error) {
+	t, e := get_transient("dissoc!", a)
+	if e != nil {
+		return nil, e
+	}
+	for _, k := range a[1:] {
+		if e := t.Dissoc(k); e != nil {
+			return nil, e
+		}
+	}
+	return t, nil
+}
+
+func disj_BANG(a []MalType) (MalType, error) {
+	t, e := get_transient("disj!", a)
+	if e != nil {
+		return nil, e
+	}
+	for _, x := range a[1:] {
+		if e := t.Disj(x); e != nil {
+			return nil, e
+		}
+	}
+	return t, nil
+}
+
+func pop_BANG(a []MalType) (MalType, error) {
+	t, e := get_transient("pop!", a)
+	if e != nil {
+		return nil, e
+	}
+	return t, t.Pop()
+}
+
+func persistent_BANG(a []MalType) (MalType, error) {
+	t, e := get_transient("persistent!", a)
+	if e != nil {
+		return nil, e
+	}
+	return t.Persistent()
+}
+
+// Metadata functions
+func vary_meta(a []MalType) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New("vary-meta requires at least 2 args")
+	}
+	m, e := GetMeta(a[0])
+	if e != nil {
+		return nil, e
+	}
+	m, e = Apply(a[1], append([]MalType{m}, a[2:]...))
+	if e != nil {
+		return nil, e
+	}
+	return WithMeta(a[0], m)
+}
+
+func alter_meta_BANG(a []MalType) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New("alter-meta! requires at least 2 args")
+	}
+	return AlterMeta(a[0], func(m MalType) (MalType, error) {
+		return Apply(a[1], append([]MalType{m}, a[2:]...))
+	})
+}
+
+func reset_meta_BANG(a []MalType) (MalType, error) {
+	return AlterMeta(a[0], func(MalType) (MalType, error) { return a[1], nil })
+}
+
+// Atom functions
+func get_atom(name string, obj MalType) (*Atom, error) {
+	atm, ok := obj.(*Atom)
+	if !ok {
+		return nil, errors.New(name + " called with non-atom")
+	}
+	return atm, nil
+}
+
+// (deref ref) or (deref ref timeout-ms timeout-val), the timeout
+// for futures and promises only
+func deref(a []MalType) (MalType, error) {
+	if len(a) != 1 && len(a) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 1 or 3)", len(a))
+	}
+	timeout := time.Duration(-1)
+	if len(a) == 3 {
+		ms, ok := a[1].(int)
+		if !ok {
+			return nil, errors.New("deref timeout must be a number")
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	switch r := a[0].(type) {
+	case *Future:
+		val, ok, e := r.Deref(timeout)
+		if !ok {
+			return a[2], nil
+		}
+		return val, e
+	case *Promise:
+		val, ok := r.Deref(timeout)
+		if !ok {
+			return a[2], nil
+		}
+		return val, nil
+	}
+	if len(a) == 3 {
+		return nil, errors.New("deref with timeout called on " + TypeName(a[0]))
+	}
+	switch r := a[0].(type) {
+	case *Atom:
+		return r.Deref(), nil
+	case *Ref:
+		return r.Deref(), nil
+	case *Agent:
+		return r.Deref(), nil
+	case *Delay:
+		return r.Force()
+	default:
+		return nil, errors.New("deref called with non-reference")
+	}
+}
+
+func reset_BANG(a []MalType) (MalType, error) {
+	atm, e := get_atom("reset!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	if _, e := atm.Reset(a[1]); e != nil {
+		return nil, e
+	}
+	return a[1], nil
+}
+
+func reset_vals_BANG(a []MalType) (MalType, error) {
+	atm, e := get_atom("reset-vals!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	old, e := atm.Reset(a[1])
+	if e != nil {
+		return nil, e
+	}
+	return NewVector(old, a[1]), nil
+}
+
+func swap(name string, a []MalType) (MalType, MalType, error) {
+	if len(a) < 2 {
+		return nil, nil, errors.New(name + " requires at least 2 args")
+	}
+	atm, e := get_atom(name, a[0])
+	if e != nil {
+		return nil, nil, e
+	}
+	return atm.Swap(func(old MalType) (MalType, error) {
+		return Apply(a[1], append([]MalType{old}, a[2:]...))
+	})
+}
+
+func swap_BANG(a []MalType) (MalType, error) {
+	_, res, e := swap("swap!", a)
+	return res, e
+}
+
+func swap_vals_BANG(a []MalType) (MalType, error) {
+	old, res, e := swap("swap-vals!", a)
+	if e != nil {
+		return nil, e
+	}
+	return NewVector(old, res), nil
+}
+
+func compare_and_set_BANG(a []MalType) (MalType, error) {
+	atm, e := get_atom("compare-and-set!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return atm.CompareAndSet(a[1], a[2])
+}
+
+func add_watch(a []MalType) (MalType, error) {
+	atm, e := get_atom("add-watch", a[0])
+	if e != nil {
+		return nil, e
+	}
+	atm.AddWatch(a[1], a[2])
+	return atm, nil
+}
+
+func remove_watch(a []MalType) (MalType, error) {
+	atm, e := get_atom("remove-watch", a[0])
+	if e != nil {
+		return nil, e
+	}
+	atm.RemoveWatch(a[1])
+	return atm, nil
+}
+
+func set_validator_BANG(a []MalType) (MalType, error) {
+	atm, e := get_atom("set-validator!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return nil, atm.SetValidator(a[1])
+}
+
+func get_validator(a []MalType) (MalType, error) {
+	atm, e := get_atom("get-validator", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return atm.Validator(), nil
+}
+
+// Ref functions
+func get_ref(name string, obj MalType) (*Ref, error) {
+	r, ok := obj.(*Ref)
+	if !ok {
+		return nil, errors.New(name + " called with non-ref")
+	}
+	return r, nil
+}
+
+func dosync(a []MalType) (MalType, error) {
+	return RunInTx(func() (MalType, error) { return Apply(a[0], []MalType{}) })
+}
+
+func ref_set(a []MalType) (MalType, error) {
+	r, e := get_ref("ref-set", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return r.Set(a[1])
+}
+
+func alter(a []MalType) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New("alter requires at least 2 args")
+	}
+	r, e := get_ref("alter", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return r.Alter(a[1], a[2:])
+}
+
+func commute(a []MalType) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New("commute requires at least 2 args")
+	}
+	r, e := get_ref("commute", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return r.Commute(a[1], a[2:])
+}
+
+func ensure(a []MalType) (MalType, error) {
+	r, e := get_ref("ensure", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return r.Ensure()
+}
+
+// Agent functions
+func get_agent(name string, obj MalType) (*Agent, error) {
+	ag, ok := obj.(*Agent)
+	if !ok {
+		return nil, errors.New(name + " called with non-agent")
+	}
+	return ag, nil
+}
+
+// send is also how messages are sent to processes: (send pid msg)
+func send(name string, a []MalType, pooled bool) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New(name + " requires at least 2 args")
+	}
+	if p, ok := a[0].(*Process); ok && name == "send" {
+		if len(a) != 2 {
+			return nil, errors.New("send to a process requires a single message")
+		}
+		p.Send(a[1])
+		return a[1], nil
+	}
+	ag, e := get_agent(name, a[0])
+	if e != nil {
+		return nil, e
+	}
+	return ag, ag.Send(a[1], a[2:], pooled)
+}
+
+func await(a []MalType) (MalType, error) {
+	for _, obj := range a {
+		ag, e := get_agent("await", obj)
+		if e != nil {
+			return nil, e
+		}
+		if e := ag.Await(); e != nil {
+			return nil, e
+		}
+	}
+	return nil, nil
+}
+
+func agent_error(a []MalType) (MalType, error) {
+	ag, e := get_agent("agent-error", a[0])
+	if e != nil {
+		return nil, e
+	}
+	switch e := ag.Failure().(type) {
+	case nil:
+		return nil, nil
+	case MalError:
+		return e.Obj, nil
+	default:
+		return e.Error(), nil
+	}
+}
+
+// (restart-agent agent state :clear-actions true)
+func restart_agent(a []MalType) (MalType, error) {
+	if len(a) != 2 && len(a) != 4 {
+		return nil, errors.New("restart-agent requires an agent, a state and options")
+	}
+	ag, e := get_agent("restart-agent", a[0])
+	if e != nil {
+		return nil, e
+	}
+	clear := len(a) == 4 && a[2] == "\u029eclear-actions" && a[3] != nil && a[3] != false
+	return a[1], ag.Restart(a[1], clear)
+}
+
+// Future, promise and delay functions
+func future_call(a []MalType) (MalType, error) {
+	f := a[0]
+	return NewFuture(func() (MalType, error) { return Apply(f, []MalType{}) }), nil
+}
+
+func delay(a []MalType) (MalType, error) {
+	f := a[0]
+	return NewDelay(func() (MalType, error) { return Apply(f, []MalType{}) }), nil
+}
+
+func deliver(a []MalType) (MalType, error) {
+	p, ok := a[0].(*Promise)
+	if !ok {
+		return nil, errors.New("deliver called with non-promise")
+	}
+	if !p.Deliver(a[1]) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func force(a []MalType) (MalType, error) {
+	if d, ok := a[0].(*Delay); ok {
+		return d.Force()
+	}
+	return a[0], nil
+}
+
+func realized_Q(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
+	case *Future:
+		return obj.Realized(), nil
+	case *Promise:
+		return obj.Realized(), nil
+	case *Delay:
+		return obj.Realized(), nil
+	case LazySeq:
+		return obj.Realized(), nil
+	default:
+		return nil, errors.New("realized? not supported on " + TypeName(a[0]))
+	}
+}
+
+// Channel functions
+func get_chan(name string, obj MalType) (*Chan, error) {
+	c, ok := obj.(*Chan)
+	if !ok {
+		return nil, errors.New(name + " called with non-channel")
+	}
+	return c, nil
+}
+
+// errors from goroutines nobody waits for are only reported
+func report_async_error(where string, e error) {
+	if me, ok := e.(MalError); ok {
+		fmt.Fprintf(os.Stderr, "Error in %s: %s\n", where, printer.Pr_str(me.Obj, true))
+	} else {
+		fmt.Fprintf(os.Stderr, "Error in %s: %s\n", where, e.Error())
+	}
+}
+
+func make_chan(a []MalType) (MalType, error) {
+	if len(a) > 1 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 0 or 1)", len(a))
+	}
+	buf := 0
+	if len(a) == 1 && a[0] != nil {
+		n, ok := a[0].(int)
+		if !ok || n < 0 {
+			return nil, errors.New("chan buffer size must be a non-negative number")
+		}
+		buf = n
+	}
+	return NewChan(buf), nil
+}
+
+func chan_put(a []MalType) (MalType, error) {
+	c, e := get_chan(">!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return c.Put(a[1])
+}
+
+func chan_take(a []MalType) (MalType, error) {
+	c, e := get_chan("<!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return c.Take(), nil
+}
+
+// (put! ch val) or (put! ch val callback), without blocking
+func put_BANG(a []MalType) (MalType, error) {
+	if len(a) != 2 && len(a) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 2 or 3)", len(a))
+	}
+	c, e := get_chan("put!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	if a[1] == nil {
+		return nil, errors.New("can't put nil on a channel")
+	}
+	if c.Closed() {
+		return false, nil
+	}
+	Go(func() {
+		ok, _ := c.Put(a[1])
+		if len(a) == 3 {
+			if _, e := Apply(a[2], []MalType{ok}); e != nil {
+				report_async_error("put! callback", e)
+			}
+		}
+	})
+	return true, nil
+}
+
+// (take! ch callback), without blocking
+func take_BANG(a []MalType) (MalType, error) {
+	c, e := get_chan("take!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	Go(func() {
+		if _, e := Apply(a[1], []MalType{c.Take()}); e != nil {
+			report_async_error("take! callback", e)
+		}
+	})
+	return nil, nil
+}
+
+func close_BANG(a []MalType) (MalType, error) {
+	c, e := get_chan("close!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	c.Close()
+	return nil, nil
+}
+
+// (alts! [ch1 [ch2 val] ...] :default val) returns [val port]
+func alts_BANG(a []MalType) (MalType, error) {
+	if len(a) != 1 && len(a) != 3 {
+		return nil, errors.New("alts! requires ports and optionally :default val")
+	}
+	ports, e := GetSlice(a[0])
+	if e != nil {
+		return nil, e
+	}
+	ops := []AltOp{}
+	for _, port := range ports {
+		if put, ok := port.(Vector); ok && put.Count() == 2 {
+			pc, _ := put.Nth(0)
+			val, _ := put.Nth(1)
+			c, e := get_chan("alts!", pc)
+			if e != nil {
+				return nil, e
+			}
+			ops = append(ops, AltOp{c, true, val})
+		} else {
+			c, e := get_chan("alts!", port)
+			if e != nil {
+				return nil, e
+			}
+			ops = append(ops, AltOp{Chan: c})
+		}
+	}
+	wait := true
+	if len(a) == 3 {
+		if a[1] != "\u029edefault" {
+			return nil, errors.New("alts! only supports the :default option")
+		}
+		wait = false
+	}
+	if len(ops) == 0 && wait {
+		return nil, errors.New("alts! requires at least one port")
+	}
+	val, i, e := Alts(ops, wait)
+	if e != nil {
+		return nil, e
+	}
+	if i < 0 {
+		return NewVector(a[2], a[1]), nil
+	}
+	return NewVector(val, ops[i].Chan), nil
+}
+
+func timeout(a []MalType) (MalType, error) {
+	ms, ok := a[0].(int)
+	if !ok {
+		return nil, errors.New("timeout requires a number of milliseconds")
+	}
+	return Timeout(time.Duration(ms) * time.Millisecond), nil
+}
+
+// go_block runs f on a new goroutine and returns a channel that gets
+// its result, if not nil, and is then closed
+func go_block(a []MalType) (MalType, error) {
+	f := a[0]
+	c := NewChan(1)
+	Go(func() {
+		res, e := Apply(f, []MalType{})
+		if e != nil {
+			report_async_error("go block", e)
+		} else if res != nil {
+			c.Put(res)
+		}
+		c.Close()
+	})
+	return c, nil
+}
+
+// (pipeline n to f from) or (pipeline n to f from close?)
+func pipeline(a []MalType) (MalType, error) {
+	if len(a) != 4 && len(a) != 5 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 4 or 5)", len(a))
+	}
+	n, ok := a[0].(int)
+	if !ok || n < 1 {
+		return nil, errors.New("pipeline requires a positive number of workers")
+	}
+	to, e := get_chan("pipeline", a[1])
+	if e != nil {
+		return nil, e
+	}
+	from, e := get_chan("pipeline", a[3])
+	if e != nil {
+		return nil, e
+	}
+	Pipeline(n, to, a[2], from, len(a) == 4 || (a[4] != nil && a[4] != false), func(e error) {
+		report_async_error("pipeline", e)
+	})
+	return to, nil
+}
+
+// (pipe from to) or (pipe from to close?)
+func pipe(a []MalType) (MalType, error) {
+	if len(a) != 2 && len(a) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 2 or 3)", len(a))
+	}
+	from, e := get_chan("pipe", a[0])
+	if e != nil {
+		return nil, e
+	}
+	to, e := get_chan("pipe", a[1])
+	if e != nil {
+		return nil, e
+	}
+	close_to := len(a) == 2 || (a[2] != nil && a[2] != false)
+	Go(func() {
+		for val := from.Take(); val != nil; val = from.Take() {
+			if ok, _ := to.Put(val); !ok {
+				break
+			}
+		}
+		if close_to {
+			to.Close()
+		}
+	})
+	return to, nil
+}
+
+// (onto-chan! ch coll) or (onto-chan! ch coll close?) returns a
+// channel that closes once all the elements are put
+func onto_chan_BANG(a []MalType) (MalType, error) {
+	if len(a) != 2 && len(a) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 2 or 3)", len(a))
+	}
+	c, e := get_chan("onto-chan!", a[0])
+	if e != nil {
+		return nil, e
+	}
+	elems, e := GetSlice(a[1])
+	if e != nil {
+		return nil, e
+	}
+	close_c := len(a) == 2 || (a[2] != nil && a[2] != false)
+	done := NewChan(0)
+	Go(func() {
+		for _, x := range elems {
+			if ok, _ := c.Put(x); !ok {
+				break
+			}
+		}
+		if close_c {
+			c.Close()
+		}
+		done.Close()
+	})
+	return done, nil
+}
+
+func to_chan_BANG(a []MalType) (MalType, error) {
+	elems, e := GetSlice(a[0])
+	if e != nil {
+		return nil, e
+	}
+	c := NewChan(len(elems))
+	for _, x := range elems {
+		if _, e := c.Put(x); e != nil {
+			return nil, e
+		}
+	}
+	c.Close()
+	return c, nil
+}
+
+// Process functions
+func get_process(name string, obj MalType) (*Process, error) {
+	p, ok := obj.(*Process)
+	if !ok {
+		return nil, errors.New(name + " called with non-process")
+	}
+	return p, nil
+}
+
+func spawn(name string, a []MalType, link bool) (MalType, error) {
+	if len(a) < 1 {
+		return nil, errors.New(name + " requires a function")
+	}
+	return Spawn(a[0], a[1:], link), nil
+}
+
+func link(a []MalType) (MalType, error) {
+	p, e := get_process("link", a[0])
+	if e != nil {
+		return nil, e
+	}
+	Self().Link(p)
+	return true, nil
+}
+
+func monitor(a []MalType) (MalType, error) {
+	p, e := get_process("monitor", a[0])
+	if e != nil {
+		return nil, e
+	}
+	Self().Monitor(p)
+	return p, nil
+}
+
+func process_alive_Q(a []MalType) (MalType, error) {
+	p, e := get_process("process-alive?", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return p.Alive(), nil
+}
+
+// Parallel functions
+func pmap(a []MalType) (MalType, error) {
+	if len(a) < 2 {
+		return nil, errors.New("pmap requires at least 2 arguments")
+	}
+	// only as many elements as the shortest collection has are taken
+	seqs := make([]MalType, len(a)-1)
+	for j, coll := range a[1:] {
+		seq, e := to_seq(coll)
+		if e != nil {
+			return nil, e
+		}
+		seqs[j] = seq
+	}
+	arg_lists := [][]MalType{}
+collect:
+	for {
+		args := make([]MalType, len(seqs))
+		for j, seq := range seqs {
+			first, rest, ok, e := Uncons(seq)
+			if e != nil {
+				return nil, e
+			}
+			if !ok {
+				break collect
+			}
+			args[j], seqs[j] = first, rest
+		}
+		arg_lists = append(arg_lists, args)
+	}
+	results, e := ParallelMap(len(arg_lists), func(i int) (MalType, error) {
+		return Apply(a[0], arg_lists[i])
+	})
+	if e != nil {
+		return nil, e
+	}
+	return List{results, nil}, nil
+}
+
+func pcalls(a []MalType) (MalType, error) {
+	results, e := ParallelMap(len(a), func(i int) (MalType, error) {
+		return Apply(a[i], []MalType{})
+	})
+	if e != nil {
+		return nil, e
+	}
+	return List{results, nil}, nil
+}
+
+// (preduce f coll) or (preduce f val coll), f must be associative
+func preduce(a []MalType) (MalType, error) {
+	if len(a) != 2 && len(a) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 2 or 3)", len(a))
+	}
+	elems, e := GetSlice(a[len(a)-1])
+	if e != nil {
+		return nil, e
+	}
+	if len(elems) == 0 {
+		if len(a) == 3 {
+			return a[1], nil
+		}
+		return Apply(a[0], []MalType{})
+	}
+	res, e := ParallelReduce(a[0], elems)
+	if e != nil || len(a) == 2 {
+		return res, e
+	}
+	return Apply(a[0], []MalType{a[1], res})
+}
+
+// Timer functions
+func get_millis(name string, obj MalType) (time.Duration, error) {
+	ms, ok := obj.(int)
+	if !ok || ms < 0 {
+		return 0, errors.New(name + " requires a number of milliseconds")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// the mal function called with the error value and the timer when a
+// timer callback fails, or nil to report errors on stderr
+var timer_error_handler = NewAtom(nil)
+
+func timer_callback(f MalType) func(*Timer) {
+	return func(t *Timer) {
+		_, e := Apply(f, []MalType{})
+		if e == nil {
+			return
+		}
+		handler := timer_error_handler.Deref()
+		if handler == nil {
+			report_async_error("timer", e)
+			return
+		}
+		var obj MalType = e.Error()
+		if me, ok := e.(MalError); ok {
+			obj = me.Obj
+		}
+		if _, e := Apply(handler, []MalType{obj, t}); e != nil {
+			report_async_error("timer error handler", e)
+		}
+	}
+}
+
+func sleep(a []MalType) (MalType, error) {
+	d, e := get_millis("sleep", a[0])
+	if e != nil {
+		return nil, e
+	}
+	time.Sleep(d)
+	return nil, nil
+}
+
+func set_timeout(a []MalType) (MalType, error) {
+	d, e := get_millis("set-timeout", a[1])
+	if e != nil {
+		return nil, e
+	}
+	return After(d, timer_callback(a[0])), nil
+}
+
+func set_interval(a []MalType) (MalType, error) {
+	d, e := get_millis("set-interval", a[1])
+	if e != nil {
+		return nil, e
+	}
+	if d == 0 {
+		return nil, errors.New("set-interval requires a positive interval")
+	}
+	return Every(d, timer_callback(a[0])), nil
+}
+
+// (schedule f "*/5 * * * *") calls f at every time matching the cron
+// expression
+func schedule(a []MalType) (MalType, error) {
+	expr, ok := a[1].(string)
+	if !ok {
+		return nil, errors.New("schedule requires a cron expression")
+	}
+	c, e := ParseCron(expr)
+	if e != nil {
+		return nil, e
+	}
+	t, ok := Schedule(c, timer_callback(a[0]))
+	if !ok {
+		return nil, errors.New("cron expression never matches: " + expr)
+	}
+	return t, nil
+}
+
+func get_timer(name string, obj MalType) (*Timer, error) {
+	t, ok := obj.(*Timer)
+	if !ok {
+		return nil, errors.New(name + " called with non-timer")
+	}
+	return t, nil
+}
+
+func cancel_timer(a []MalType) (MalType, error) {
+	t, e := get_timer("cancel-timer", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return t.Cancel(), nil
+}
+
+func timer_active_Q(a []MalType) (MalType, error) {
+	t, e := get_timer("timer-active?", a[0])
+	if e != nil {
+		return nil, e
+	}
+	return t.Active(), nil
+}
+
+func set_timer_error_handler(a []MalType) (MalType, error) {
+	if a[0] != nil && !Func_Q(a[0]) && !MalFunc_Q(a[0]) {
+		return nil, errors.New("set-timer-error-handler! requires a function or nil")
+	}
+	timer_error_handler.Reset(a[0])
+	return nil, nil
+}
+
+// Environment functions
+func get_env(name string, obj MalType) (EnvType, error) {
+	env, ok := obj.(EnvType)
+	if !ok {
+		return nil, errors.New(name + " called with non-environment")
+	}
+	return env, nil
+}
+
+func get_env_symbol(name string, a []MalType) (EnvType, Symbol, error) {
+	env, e := get_env(name, a[0])
+	if e != nil {
+		return nil, Symbol{}, e
+	}
+	sym, ok := a[1].(Symbol)
+	if !ok {
+		return nil, Symbol{}, errors.New(name + " requires a symbol")
+	}
+	return env, sym, nil
+}
+
+// (env-new), (env-new outer) or (env-new outer {'sym val ...}); without
+// an outer environment the new one is a root environment
+func env_new(a []MalType) (MalType, error) {
+	if len(a) > 2 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 0 to 2)", len(a))
+	}
+	var outer EnvType
+	if len(a) > 0 && a[0] != nil {
+		var e error
+		if outer, e = get_env("env-new", a[0]); e != nil {
+			return nil, e
+		}
+	}
+	binds, exprs := []MalType{}, []MalType{}
+	if len(a) == 2 && a[1] != nil {
+		entries, e := MapEntries(a[1])
+		if e != nil {
+			return nil, errors.New("env-new requires a map of bindings")
+		}
+		for _, ent := range entries {
+			if !Symbol_Q(ent.Key) || ent.Key.(Symbol).Val == "&" {
+				return nil, errors.New("env-new bindings require symbols as keys")
+			}
+			binds = append(binds, ent.Key)
+			exprs = append(exprs, ent.Val)
+		}
+	}
+	return env.NewEnv(outer, List{binds, nil}, List{exprs, nil})
+}
+
+// (env-get env sym) or (env-get env sym not-found)
+func env_get(a []MalType) (MalType, error) {
+	if len(a) != 2 && len(a) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 2 or 3)", len(a))
+	}
+	env, sym, e := get_env_symbol("env-get", a)
+	if e != nil {
+		return nil, e
+	}
+	if len(a) == 3 {
+		if val, ok := env.Lookup(sym); ok {
+			return val, nil
+		}
+		return a[2], nil
+	}
+	return env.Get(sym)
+}
+
+func env_set(a []MalType) (MalType, error) {
+	env, sym, e := get_env_symbol("env-set!", a)
+	if e != nil {
+		return nil, e
+	}
+	return env.Set(sym, a[2]), nil
+}
+
+func env_find(a []MalType) (MalType, error) {
+	env, sym, e := get_env_symbol("env-find", a)
+	if e != nil {
+		return nil, e
+	}
+	if found := env.Find(sym); found != nil {
+		return found, nil
+	}
+	return nil, nil
+}
+
+func env_outer(a []MalType) (MalType, error) {
+	env, e := get_env("env-outer", a[0])
+	if e != nil {
+		return nil, e
+	}
+	if outer := env.Outer(); outer != nil {
+		return outer, nil
+	}
+	return nil, nil
+}
+
+func env_Q(obj MalType) bool {
+	_, ok := obj.(EnvType)
+	return ok
 }
 
 // core namespace
@@ -449,7 +2522,7 @@ var NS = map[string]MalType{
 	"nil?":    call1b(Nil_Q),
 	"true?":   call1b(True_Q),
 	"false?":  call1b(False_Q),
-	"symbol":  call1e(func(a []MalType) (MalType, error) { return Symbol{a[0].(string)}, nil }),
+	"symbol":  call1e(func(a []MalType) (MalType, error) { return Symbol{a[0].(string), nil}, nil }),
 	"symbol?": call1b(Symbol_Q),
 	"string?": call1e(func(a []MalType) (MalType, error) { return (String_Q(a[0]) && !Keyword_Q(a[0])), nil }),
 	"keyword": call1e(func(a []MalType) (MalType, error) {
@@ -470,10 +2543,10 @@ var NS = map[string]MalType{
 	"read-string": call1e(func(a []MalType) (MalType, error) { return reader.Read_str(a[0].(string)) }),
 	"slurp":       call1e(slurp),
 	"readline":    call1e(func(a []MalType) (MalType, error) { return readline.Readline(a[0].(string)) }),
-	"<":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) < a[1].(int), nil }),
-	"<=":          call2e(func(a []MalType) (MalType, error) { return a[0].(int) <= a[1].(int), nil }),
-	">":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) > a[1].(int), nil }),
-	">=":          call2e(func(a []MalType) (MalType, error) { return a[0].(int) >= a[1].(int), nil }),
+	"<":           call2e(ordered(func(c int) bool { return c < 0 })),
+	"<=":          call2e(ordered(func(c int) bool { return c <= 0 })),
+	">":           call2e(ordered(func(c int) bool { return c > 0 })),
+	">=":          call2e(ordered(func(c int) bool { return c >= 0 })),
 	"+":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) + a[1].(int), nil }),
 	"-":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) - a[1].(int), nil }),
 	"*":           call2e(func(a []MalType) (MalType, error) { return a[0].(int) * a[1].(int), nil }),
@@ -481,10 +2554,12 @@ var NS = map[string]MalType{
 	"time-ms":     call0e(time_ms),
 	"list":        callNe(func(a []MalType) (MalType, error) { return List{a, nil}, nil }),
 	"list?":       call1b(List_Q),
-	"vector":      callNe(func(a []MalType) (MalType, error) { return Vector{a, nil}, nil }),
+	"vector":      callNe(func(a []MalType) (MalType, error) { return NewVector(a...), nil }),
 	"vector?":     call1b(Vector_Q),
 	"hash-map":    callNe(func(a []MalType) (MalType, error) { return NewHashMap(List{a, nil}) }),
-	"map?":        call1b(HashMap_Q),
+	"array-map":   callNe(func(a []MalType) (MalType, error) { return NewArrayMap(List{a, nil}) }),
+	"map?":        call1b(map_Q),
+	"hash":        call1e(func(a []MalType) (MalType, error) { return int(Hash(a[0])), nil }),
 	"assoc":       callNe(assoc),  // at least 3
 	"dissoc":      callNe(dissoc), // at least 2
 	"get":         call2e(get),
@@ -500,17 +2575,169 @@ var NS = map[string]MalType{
 	"rest":        call1e(rest),
 	"empty?":      call1e(empty_Q),
 	"count":       call1e(count),
-	"apply":       callNe(apply), // at least 2
-	"map":         call2e(do_map),
-	"conj":        callNe(conj), // at least 2
+	"apply":       callNe(apply),  // at least 2
+	"map":         callNe(do_map), // at least 2
+	"conj":        callNe(conj),   // at least 2
+	"peek":        call1e(peek),
+	"pop":         call1e(pop),
 	"seq":         call1e(seq),
-	"with-meta":   call2e(with_meta),
-	"meta":        call1e(meta),
-	"atom":        call1e(func(a []MalType) (MalType, error) { return &Atom{a[0], nil}, nil }),
+	"with-meta":   call2e(func(a []MalType) (MalType, error) { return WithMeta(a[0], a[1]) }),
+	"meta":        call1e(func(a []MalType) (MalType, error) { return GetMeta(a[0]) }),
+	"atom":        call1e(func(a []MalType) (MalType, error) { return NewAtom(a[0]), nil }),
 	"atom?":       call1b(Atom_Q),
-	"deref":       call1e(deref),
+	"deref":       callNe(deref), // 1 or 3
 	"reset!":      call2e(reset_BANG),
 	"swap!":       callNe(swap_BANG),
+
+	"hash-set":     callNe(func(a []MalType) (MalType, error) { return NewSet(a...), nil }),
+	"set":          call1e(set),
+	"set?":         call1b(SetLike_Q),
+	"disj":         callNe(disj), // at least 1
+	"union":        callNe(union),
+	"intersection": callNe(intersection), // at least 1
+	"difference":   callNe(difference),   // at least 1
+	"subset?":      call2e(subset_Q),
+	"superset?":    call2e(func(a []MalType) (MalType, error) { return subset_Q([]MalType{a[1], a[0]}) }),
+
+	"lazy-seq*": call1e(lazy_seq),
+	"lazy-seq?": call1b(LazySeq_Q),
+	"filter":    call2e(filter),
+	"take":      call2e(take),
+	"drop":      call2e(drop),
+	"iterate":   call2e(func(a []MalType) (MalType, error) { return iterate_seq(a[0], a[1]), nil }),
+	"repeat":    callNe(repeat),
+	"cycle":     call1e(cycle),
+	"range":     callNe(do_range),
+	"line-seq":  call1e(line_seq),
+	"doall":     call1e(doall),
+
+	"compare": call2e(compare),
+	"sort":    callNe(do_sort),
+	"sort-by": callNe(sort_by),
+	"min-key": callNe(func(a []MalType) (MalType, error) { return extreme_key(a, 1) }),
+	"max-key": callNe(func(a []MalType) (MalType, error) { return extreme_key(a, -1) }),
+
+	"sorted-map":    callNe(func(a []MalType) (MalType, error) { return sorted_map(nil, a) }),
+	"sorted-map-by": callNe(sorted_map_by), // at least 1
+	"sorted-set":    callNe(func(a []MalType) (MalType, error) { return sorted_set(nil, a) }),
+	"sorted-set-by": callNe(sorted_set_by), // at least 1
+	"sorted?":       call1b(func(obj MalType) bool { return SortedMap_Q(obj) || SortedSet_Q(obj) }),
+	"subseq":        callNe(func(a []MalType) (MalType, error) { return subseq("subseq", a, true) }),
+	"rsubseq":       callNe(func(a []MalType) (MalType, error) { return subseq("rsubseq", a, false) }),
+
+	"record-constructor*":     call3e(record_constructor),
+	"map-record-constructor*": call1e(map_record_constructor),
+	"record?":                 call1b(Record_Q),
+	"type":                    call1e(func(a []MalType) (MalType, error) { return Symbol{TypeName(a[0]), nil}, nil }),
+
+	"protocol*":        call2e(protocol),
+	"protocol-method*": call2e(protocol_method),
+	"extend-type*":     callNe(extend_type),     // at least 1
+	"extend-protocol*": callNe(extend_protocol), // at least 1
+	"satisfies?":       call2e(satisfies_Q),
+
+	"multi-fn*":     call3e(multi_fn),
+	"add-method*":   call3e(add_method),
+	"remove-method": call2e(remove_method),
+	"methods":       call1e(methods),
+	"derive":        call2e(derive),
+	"underive":      call2e(func(a []MalType) (MalType, error) { Underive(a[0], a[1]); return nil, nil }),
+	"isa?":          call2e(func(a []MalType) (MalType, error) { return Isa(a[0], a[1]), nil }),
+	"parents":       call1e(func(a []MalType) (MalType, error) { return Parents(a[0]), nil }),
+	"ancestors":     call1e(func(a []MalType) (MalType, error) { return Ancestors(a[0]), nil }),
+
+	"transient":   call1e(func(a []MalType) (MalType, error) { return NewTransient(a[0]) }),
+	"persistent!": call1e(persistent_BANG),
+	"conj!":       callNe(conj_BANG),   // at least 1
+	"assoc!":      callNe(assoc_BANG),  // at least 1
+	"dissoc!":     callNe(dissoc_BANG), // at least 1
+	"disj!":       callNe(disj_BANG),   // at least 1
+	"pop!":        call1e(pop_BANG),
+	"transient?":  call1b(Transient_Q),
+
+	"vary-meta":   callNe(vary_meta),       // at least 2
+	"alter-meta!": callNe(alter_meta_BANG), // at least 2
+	"reset-meta!": call2e(reset_meta_BANG),
+
+	"swap-vals!":       callNe(swap_vals_BANG), // at least 2
+	"reset-vals!":      call2e(reset_vals_BANG),
+	"compare-and-set!": call3e(compare_and_set_BANG),
+	"add-watch":        call3e(add_watch),
+	"remove-watch":     call2e(remove_watch),
+	"set-validator!":   call2e(set_validator_BANG),
+	"get-validator":    call1e(get_validator),
+
+	"ref":     call1e(func(a []MalType) (MalType, error) { return NewRef(a[0]), nil }),
+	"ref?":    call1b(Ref_Q),
+	"dosync*": call1e(dosync),
+	"ref-set": call2e(ref_set),
+	"alter":   callNe(alter),   // at least 2
+	"commute": callNe(commute), // at least 2
+	"ensure":  call1e(ensure),
+
+	"agent":         call1e(func(a []MalType) (MalType, error) { return NewAgent(a[0]), nil }),
+	"agent?":        call1b(Agent_Q),
+	"send":          callNe(func(a []MalType) (MalType, error) { return send("send", a, true) }),      // at least 2
+	"send-off":      callNe(func(a []MalType) (MalType, error) { return send("send-off", a, false) }), // at least 2
+	"await":         callNe(await),
+	"agent-error":   call1e(agent_error),
+	"restart-agent": callNe(restart_agent), // 2 or 4
+
+	"future-call":  call1e(future_call),
+	"future?":      call1b(Future_Q),
+	"future-done?": call1b(func(obj MalType) bool { return Future_Q(obj) && obj.(*Future).Realized() }),
+	"promise":      call0e(func(a []MalType) (MalType, error) { return NewPromise(), nil }),
+	"deliver":      call2e(deliver),
+	"delay*":       call1e(delay),
+	"delay?":       call1b(Delay_Q),
+	"force":        call1e(force),
+	"realized?":    call1e(realized_Q),
+
+	"chan":       callNe(make_chan), // 0 or 1
+	"chan?":      call1b(Chan_Q),
+	">!":         call2e(chan_put),
+	">!!":        call2e(chan_put),
+	"<!":         call1e(chan_take),
+	"<!!":        call1e(chan_take),
+	"put!":       callNe(put_BANG), // 2 or 3
+	"take!":      call2e(take_BANG),
+	"close!":     call1e(close_BANG),
+	"alts!":      callNe(alts_BANG), // 1 or 3
+	"alts!!":     callNe(alts_BANG), // 1 or 3
+	"timeout":    call1e(timeout),
+	"go*":        call1e(go_block),
+	"pipeline":   callNe(pipeline),       // 4 or 5
+	"pipe":       callNe(pipe),           // 2 or 3
+	"onto-chan!": callNe(onto_chan_BANG), // 2 or 3
+	"to-chan!":   call1e(to_chan_BANG),
+
+	"spawn":          callNe(func(a []MalType) (MalType, error) { return spawn("spawn", a, false) }),     // at least 1
+	"spawn-link":     callNe(func(a []MalType) (MalType, error) { return spawn("spawn-link", a, true) }), // at least 1
+	"self":           call0e(func(a []MalType) (MalType, error) { return Self(), nil }),
+	"link":           call1e(link),
+	"monitor":        call1e(monitor),
+	"process?":       call1b(Process_Q),
+	"process-alive?": call1e(process_alive_Q),
+
+	"pmap":    callNe(pmap), // at least 2
+	"pcalls":  callNe(pcalls),
+	"preduce": callNe(preduce), // 2 or 3
+
+	"sleep":                    call1e(sleep),
+	"set-timeout":              call2e(set_timeout),
+	"set-interval":             call2e(set_interval),
+	"schedule":                 call2e(schedule),
+	"cancel-timer":             call1e(cancel_timer),
+	"timer?":                   call1b(Timer_Q),
+	"timer-active?":            call1e(timer_active_Q),
+	"set-timer-error-handler!": call1e(set_timer_error_handler),
+
+	"env-new":   callNe(env_new), // 0 to 2
+	"env?":      call1b(env_Q),
+	"env-get":   callNe(env_get), // 2 or 3
+	"env-set!":  call3e(env_set),
+	"env-find":  call2e(env_find),
+	"env-outer": call1e(env_outer),
 }
 
 // callXX functions check the number of arguments
@@ -541,6 +2768,15 @@ func call2e(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error)
 	}
 }
 
+func call3e(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
+	return func(args []MalType) (MalType, error) {
+		if len(args) != 3 {
+			return nil, fmt.Errorf("wrong number of arguments (%d instead of 3)", len(args))
+		}
+		return f(args)
+	}
+}
+
 func callNe(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
 	// just for documenting purposes, does not check anything
 	return func(args []MalType) (MalType, error) {
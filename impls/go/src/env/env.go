@@ -2,6 +2,8 @@ package env
 
 import (
 	"errors"
+	"sync"
+	"sync/atomic"
 	//"fmt"
 )
 
@@ -9,13 +11,49 @@ import (
 	. "types"
 )
 
+// Environments are safe for concurrent use. The root environment holds
+// the globals, which are looked up all the time and rarely defined
+// once a program is loaded: it keeps a cell per global in a map that
+// is never modified, and defining a new global swaps in an updated
+// copy, so lookups take no lock. Nested environments (function calls,
+// let*) are mostly used by one goroutine and are guarded by a
+// read-write mutex instead.
+//
+// Frames are nested environments whose symbols were resolved ahead of
+// time to slots: the symbol with interned id ids[i] is bound to
+// slots[i]. Slots are mostly written by the code evaluated in the
+// frame, but env-set! and futures may write them from elsewhere, so
+// they hold pointers that are swapped atomically, nil when unbound.
+// Other symbols defined in a frame go to its map.
 type Env struct {
-	data  map[string]MalType
-	outer EnvType
+	mu      sync.RWMutex // guards local, serializes writers of global
+	local   map[string]MalType
+	global  atomic.Pointer[map[string]*Cell]
+	is_root bool
+	ids     []int
+	slots   []atomic.Pointer[MalType]
+	outer   EnvType
+}
+
+// Cell holds the value of a global, so that code can keep the cell
+// instead of looking the global up each time
+type Cell struct {
+	val atomic.Pointer[MalType]
+}
+
+func (c *Cell) Get() (MalType, bool) {
+	if p := c.val.Load(); p != nil {
+		return *p, true
+	}
+	return nil, false
+}
+
+func (c *Cell) set(val MalType) {
+	c.val.Store(&val)
 }
 
 func NewEnv(outer EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error) {
-	env := Env{map[string]MalType{}, outer}
+	data := map[string]MalType{}
 
 	if binds_mt != nil && exprs_mt != nil {
 		binds, e := GetSlice(binds_mt)
@@ -30,19 +68,74 @@ func NewEnv(outer EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error)
 		// corresponding values in exprs
 		for i := 0; i < len(binds); i += 1 {
 			if Symbol_Q(binds[i]) && binds[i].(Symbol).Val == "&" {
-				env.data[binds[i+1].(Symbol).Val] = List{exprs[i:], nil}
+				data[binds[i+1].(Symbol).Val] = List{exprs[i:], nil}
 				break
 			} else {
-				env.data[binds[i].(Symbol).Val] = exprs[i]
+				data[binds[i].(Symbol).Val] = exprs[i]
 			}
 		}
 	}
-	//return &et, nil
+	env := &Env{is_root: outer == nil, outer: outer}
+	if env.is_root {
+		cells := make(map[string]*Cell, len(data))
+		for k, v := range data {
+			cells[k] = &Cell{}
+			cells[k].set(v)
+		}
+		env.global.Store(&cells)
+	} else {
+		env.local = data
+	}
 	return env, nil
 }
 
-func (e Env) Find(key Symbol) EnvType {
-	if _, ok := e.data[key.Val]; ok {
+// NewFrame returns a frame binding ids to vals, which becomes owned by
+// the frame. The slots past the end of vals are not bound yet.
+func NewFrame(outer EnvType, ids []int, vals []MalType) *Env {
+	e := &Env{outer: outer, ids: ids, slots: make([]atomic.Pointer[MalType], len(ids))}
+	for i := range vals {
+		e.slots[i].Store(&vals[i])
+	}
+	return e
+}
+
+// lookup searches this environment only
+func (e *Env) lookup(key string) (MalType, bool) {
+	if e.is_root {
+		if cell, ok := (*e.global.Load())[key]; ok {
+			return cell.Get()
+		}
+		return nil, false
+	}
+	if e.ids != nil {
+		id := Intern(key)
+		for i := len(e.ids) - 1; i >= 0; i-- {
+			if e.ids[i] != id {
+				continue
+			}
+			if val, ok := e.Slot(i); ok {
+				return val, true
+			}
+		}
+	}
+	e.mu.RLock()
+	val, ok := e.local[key]
+	e.mu.RUnlock()
+	return val, ok
+}
+
+func (e *Env) Lookup(key Symbol) (MalType, bool) {
+	if val, ok := e.lookup(key.Val); ok {
+		return val, true
+	}
+	if e.outer == nil {
+		return nil, false
+	}
+	return e.outer.Lookup(key)
+}
+
+func (e *Env) Find(key Symbol) EnvType {
+	if _, ok := e.lookup(key.Val); ok {
 		return e
 	} else if e.outer != nil {
 		return e.outer.Find(key)
@@ -51,15 +144,102 @@ func (e Env) Find(key Symbol) EnvType {
 	}
 }
 
-func (e Env) Set(key Symbol, value MalType) MalType {
-	e.data[key.Val] = value
+func (e *Env) Set(key Symbol, value MalType) MalType {
+	if e.is_root {
+		e.Cell(key).set(value)
+		return value
+	}
+	if e.ids != nil {
+		id := Intern(key.Val)
+		for i := len(e.ids) - 1; i >= 0; i-- {
+			if e.ids[i] == id {
+				e.SetSlot(i, value)
+				return value
+			}
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.local == nil {
+		e.local = map[string]MalType{}
+	}
+	e.local[key.Val] = value
 	return value
 }
 
-func (e Env) Get(key Symbol) (MalType, error) {
-	env := e.Find(key)
-	if env == nil {
-		return nil, errors.New("'" + key.Val + "' not found")
+func (e *Env) Get(key Symbol) (MalType, error) {
+	return Get(e, key)
+}
+
+// Get looks key up in env, for implementations of EnvType that have
+// nothing better to do
+func Get(env EnvType, key Symbol) (MalType, error) {
+	if val, ok := env.Lookup(key); ok {
+		return val, nil
+	}
+	return nil, errors.New("'" + key.Val + "' not found")
+}
+
+func (e *Env) IsRoot() bool {
+	return e.is_root
+}
+
+func (e *Env) Outer() EnvType {
+	return e.outer
+}
+
+// Cell returns the cell of a global of the root environment, adding an
+// unbound one if there is none yet
+func (e *Env) Cell(key Symbol) *Cell {
+	if cell, ok := (*e.global.Load())[key.Val]; ok {
+		return cell
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := *e.global.Load()
+	if cell, ok := old[key.Val]; ok {
+		return cell
+	}
+	cells := make(map[string]*Cell, len(old)+1)
+	for k, v := range old {
+		cells[k] = v
+	}
+	cell := &Cell{}
+	cells[key.Val] = cell
+	e.global.Store(&cells)
+	return cell
+}
+
+// Up returns the frame depth levels out of e, or false if one of the
+// environments on the way is another implementation of EnvType
+func (e *Env) Up(depth int) (*Env, bool) {
+	for ; depth > 0; depth-- {
+		outer, ok := e.outer.(*Env)
+		if !ok {
+			return nil, false
+		}
+		e = outer
+	}
+	return e, true
+}
+
+// Slot returns the value of slot i, or false if it isn't bound yet or
+// e has no slot i
+func (e *Env) Slot(i int) (MalType, bool) {
+	if i >= len(e.slots) {
+		return nil, false
+	}
+	if p := e.slots[i].Load(); p != nil {
+		return *p, true
+	}
+	return nil, false
+}
+
+// SetSlot binds slot i, and returns false if e has no slot i
+func (e *Env) SetSlot(i int, value MalType) bool {
+	if i >= len(e.slots) {
+		return false
 	}
-	return env.(Env).data[key.Val], nil
+	e.slots[i].Store(&value)
+	return true
 }
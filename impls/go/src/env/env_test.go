@@ -0,0 +1,187 @@
+package env
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+import (
+	. "types"
+)
+
+// Run with -race: goroutines define and look up symbols in the same
+// environments while others read them
+
+func hammer(t *testing.T, env EnvType) {
+	shared := Symbol{"shared", nil}
+	env.Set(shared, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				env.Set(Symbol{fmt.Sprintf("sym-%d-%d", g, i), nil}, i)
+				env.Set(shared, i)
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if _, e := env.Get(shared); e != nil {
+					t.Error(e)
+					return
+				}
+				sym := Symbol{fmt.Sprintf("sym-%d-%d", g, i), nil}
+				if val, e := env.Get(sym); e == nil && val != i {
+					t.Errorf("%s is %v instead of %d", sym.Val, val, i)
+					return
+				}
+				env.Find(sym)
+			}
+		}(g)
+	}
+	wg.Wait()
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 200; i++ {
+			sym := Symbol{fmt.Sprintf("sym-%d-%d", g, i), nil}
+			if val, e := env.Get(sym); e != nil || val != i {
+				t.Fatalf("%s is %v instead of %d", sym.Val, val, i)
+			}
+		}
+	}
+}
+
+func TestConcurrentGlobals(t *testing.T) {
+	root, _ := NewEnv(nil, nil, nil)
+	hammer(t, root)
+}
+
+func TestConcurrentLocals(t *testing.T) {
+	root, _ := NewEnv(nil, nil, nil)
+	local, _ := NewEnv(root, NewList(Symbol{"x", nil}), NewList(1))
+	hammer(t, local)
+	if val, _ := local.Get(Symbol{"x", nil}); val != 1 {
+		t.Fatalf("x is %v instead of 1", val)
+	}
+	if root.Find(Symbol{"shared", nil}) != nil {
+		t.Fatal("local definitions leaked into the outer environment")
+	}
+}
+
+// env-set! and futures write the slots of frames they don't run in
+func TestConcurrentFrame(t *testing.T) {
+	root, _ := NewEnv(nil, nil, nil)
+	root.Set(Symbol{"y", nil}, "global")
+	ids := []int{Intern("x"), Intern("shared"), Intern("y")}
+	frame := NewFrame(root, ids, []MalType{1})
+	if val, _ := frame.Get(Symbol{"y", nil}); val != "global" {
+		t.Fatalf("unbound y is %v instead of the global", val)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				frame.SetSlot(2, i)
+				if val, ok := frame.Slot(2); !ok || val.(int) < 0 {
+					t.Errorf("y is %v", val)
+					return
+				}
+			}
+		}(g)
+	}
+	hammer(t, frame)
+	wg.Wait()
+	if val, _ := frame.Get(Symbol{"x", nil}); val != 1 {
+		t.Fatalf("x is %v instead of 1", val)
+	}
+	if root.Find(Symbol{"shared", nil}) != nil {
+		t.Fatal("frame definitions leaked into the outer environment")
+	}
+}
+
+// a read-only environment that isn't an Env
+type constants map[string]MalType
+
+func (c constants) Lookup(key Symbol) (MalType, bool) {
+	val, ok := c[key.Val]
+	return val, ok
+}
+
+func (c constants) Find(key Symbol) EnvType {
+	if _, ok := c[key.Val]; ok {
+		return c
+	}
+	return nil
+}
+
+func (c constants) Set(key Symbol, value MalType) MalType {
+	return c[key.Val]
+}
+
+func (c constants) Get(key Symbol) (MalType, error) {
+	return Get(c, key)
+}
+
+func (c constants) Outer() EnvType {
+	return nil
+}
+
+func TestCustomOuter(t *testing.T) {
+	consts := constants{"pi": 3}
+	root, _ := NewEnv(consts, nil, nil)
+	local, _ := NewEnv(root, NewList(Symbol{"x", nil}), NewList(1))
+	root.Set(Symbol{"y", nil}, 2)
+	for sym, want := range map[string]MalType{"x": 1, "y": 2, "pi": 3} {
+		if val, e := local.Get(Symbol{sym, nil}); e != nil || val != want {
+			t.Errorf("%s is %v (%v) instead of %v", sym, val, e, want)
+		}
+	}
+	if found := local.Find(Symbol{"pi", nil}); found == nil || found.(constants)["pi"] != 3 {
+		t.Errorf("pi found in %v", found)
+	}
+	if _, e := local.Get(Symbol{"z", nil}); e == nil || e.Error() != "'z' not found" {
+		t.Errorf("z: %v", e)
+	}
+	root.Set(Symbol{"pi", nil}, 4)
+	if val, _ := local.Get(Symbol{"pi", nil}); val != 4 {
+		t.Errorf("pi is %v instead of 4", val)
+	}
+}
+
+func TestFrameUp(t *testing.T) {
+	consts := constants{"pi": 3}
+	outer := NewFrame(consts, []int{Intern("a")}, []MalType{1})
+	frame := NewFrame(outer, []int{Intern("b")}, []MalType{2})
+	if up, ok := frame.Up(1); !ok || up != outer {
+		t.Fatal("the frame out of a frame not found")
+	}
+	if _, ok := frame.Up(2); ok {
+		t.Fatal("a constants environment taken for a frame")
+	}
+	if _, ok := frame.Slot(1); ok {
+		t.Fatal("a missing slot found")
+	}
+	if frame.SetSlot(1, 3) {
+		t.Fatal("a missing slot set")
+	}
+}
+
+// a global looked up through two nested environments, as in the body
+// of a function
+func BenchmarkGlobalLookup(b *testing.B) {
+	root, _ := NewEnv(nil, nil, nil)
+	for i := 0; i < 300; i++ {
+		root.Set(Symbol{fmt.Sprintf("sym-%d", i), nil}, i)
+	}
+	fn_env, _ := NewEnv(root, NewList(Symbol{"n", nil}), NewList(1))
+	let_env, _ := NewEnv(fn_env, nil, nil)
+	sym := Symbol{"sym-42", nil}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		let_env.Get(sym)
+	}
+}
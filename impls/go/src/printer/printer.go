@@ -9,6 +9,13 @@ import (
 	"types"
 )
 
+// errors show thrown values as they are printed
+func init() {
+	types.PrintError = func(obj types.MalType) string {
+		return Pr_str(obj, true)
+	}
+}
+
 func Pr_list(lst []types.MalType, pr bool,
 	start string, end string, join string) string {
 	str_list := make([]string, 0, len(lst))
@@ -18,19 +25,36 @@ func Pr_list(lst []types.MalType, pr bool,
 	return start + strings.Join(str_list, join) + end
 }
 
+func pr_entries(entries []types.MapEntry, pr bool, start string) string {
+	str_list := make([]string, 0, len(entries)*2)
+	for _, ent := range entries {
+		str_list = append(str_list, Pr_str(ent.Key, pr))
+		str_list = append(str_list, Pr_str(ent.Val, pr))
+	}
+	return start + strings.Join(str_list, " ") + "}"
+}
+
 func Pr_str(obj types.MalType, print_readably bool) string {
 	switch tobj := obj.(type) {
 	case types.List:
 		return Pr_list(tobj.Val, print_readably, "(", ")", " ")
-	case types.Vector:
-		return Pr_list(tobj.Val, print_readably, "[", "]", " ")
-	case types.HashMap:
-		str_list := make([]string, 0, len(tobj.Val)*2)
-		for k, v := range tobj.Val {
-			str_list = append(str_list, Pr_str(k, print_readably))
-			str_list = append(str_list, Pr_str(v, print_readably))
+	case types.LazySeq:
+		slc, e := types.GetSlice(tobj)
+		if e != nil {
+			return "#<lazy-seq error: " + e.Error() + ">"
 		}
-		return "{" + strings.Join(str_list, " ") + "}"
+		return Pr_list(slc, print_readably, "(", ")", " ")
+	case types.Vector:
+		return Pr_list(tobj.Slice(), print_readably, "[", "]", " ")
+	case types.HashMap, types.ArrayMap, types.SortedMap:
+		entries, _ := types.MapEntries(obj)
+		return pr_entries(entries, print_readably, "{")
+	case types.Record:
+		return pr_entries(tobj.Entries(), print_readably, "#"+tobj.Type.Name+"{")
+	case types.Set:
+		return Pr_list(tobj.Elements(), print_readably, "#{", "}", " ")
+	case types.SortedSet:
+		return Pr_list(tobj.Elements(), print_readably, "#{", "}", " ")
 	case string:
 		if strings.HasPrefix(tobj, "\u029e") {
 			return ":" + tobj[2:len(tobj)]
@@ -53,10 +77,63 @@ func Pr_str(obj types.MalType, print_readably bool) string {
 			Pr_str(tobj.Exp, true) + ")"
 	case func([]types.MalType) (types.MalType, error):
 		return fmt.Sprintf("<function %v>", obj)
+	case *types.MultiFn:
+		return "#<multifn " + tobj.Name + ">"
+	case *types.Protocol:
+		return "#<protocol " + tobj.Name + ">"
+	case *types.Transient:
+		return "#<transient " + tobj.Kind + ">"
 	case *types.Atom:
 		return "(atom " +
-			Pr_str(tobj.Val, true) + ")"
+			Pr_str(tobj.Deref(), true) + ")"
+	case *types.Ref:
+		return "(ref " +
+			Pr_str(tobj.Deref(), true) + ")"
+	case *types.Agent:
+		return "(agent " +
+			Pr_str(tobj.Deref(), true) + ")"
+	case *types.Future:
+		return pr_pending("future", tobj.Realized(), func() types.MalType {
+			val, _, _ := tobj.Deref(-1)
+			return val
+		})
+	case *types.Promise:
+		return pr_pending("promise", tobj.Realized(), func() types.MalType {
+			val, _ := tobj.Deref(-1)
+			return val
+		})
+	case *types.Chan:
+		str := "#<chan unbuffered"
+		if tobj.Cap() > 0 {
+			str = fmt.Sprintf("#<chan buffer %d/%d", tobj.Count(), tobj.Cap())
+		}
+		if tobj.Closed() {
+			str += " closed"
+		}
+		return str + ">"
+	case *types.Process:
+		return fmt.Sprintf("#<process %d>", tobj.Id())
+	case types.EnvType:
+		return "#<env>"
+	case *types.Timer:
+		if !tobj.Active() {
+			return fmt.Sprintf("#<timer %d done>", tobj.Id())
+		}
+		return fmt.Sprintf("#<timer %d>", tobj.Id())
+	case *types.Delay:
+		return pr_pending("delay", tobj.Realized(), func() types.MalType {
+			val, _ := tobj.Force()
+			return val
+		})
 	default:
 		return fmt.Sprintf("%v", obj)
 	}
 }
+
+// values not produced yet print as pending, without waiting for them
+func pr_pending(kind string, realized bool, val func() types.MalType) string {
+	if !realized {
+		return "#<" + kind + " pending>"
+	}
+	return "#<" + kind + " " + Pr_str(val(), true) + ">"
+}
@@ -41,7 +41,7 @@ func (tr *TokenReader) peek() *string {
 func tokenize(str string) []string {
 	results := make([]string, 0, 1)
 	// Work around lack of quoting in backtick
-	re := regexp.MustCompile(`[\s,]*(~@|[\[\]{}()'` + "`" +
+	re := regexp.MustCompile(`[\s,]*(~@|#\{|[\[\]{}()'` + "`" +
 		`~^@]|"(?:\\.|[^\\"])*"?|;.*|[^\s\[\]{}('"` + "`" +
 		`,;)]*)`)
 	for _, group := range re.FindAllStringSubmatch(str, -1) {
@@ -86,7 +86,7 @@ func read_atom(rdr Reader) (MalType, error) {
 	} else if *token == "false" {
 		return false, nil
 	} else {
-		return Symbol{*token}, nil
+		return Symbol{*token, nil}, nil
 	}
 	return token, nil
 }
@@ -124,8 +124,7 @@ func read_vector(rdr Reader) (MalType, error) {
 	if e != nil {
 		return nil, e
 	}
-	vec := Vector{lst.(List).Val, nil}
-	return vec, nil
+	return NewVector(lst.(List).Val...), nil
 }
 
 func read_hash_map(rdr Reader) (MalType, error) {
@@ -133,7 +132,15 @@ func read_hash_map(rdr Reader) (MalType, error) {
 	if e != nil {
 		return nil, e
 	}
-	return NewHashMap(mal_lst)
+	return NewArrayMap(mal_lst)
+}
+
+func read_set(rdr Reader) (MalType, error) {
+	mal_lst, e := read_list(rdr, "#{", "}")
+	if e != nil {
+		return nil, e
+	}
+	return NewSet(mal_lst.(List).Val...), nil
 }
 
 func read_form(rdr Reader) (MalType, error) {
@@ -149,28 +156,28 @@ func read_form(rdr Reader) (MalType, error) {
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"quote"}, form}, nil}, nil
+		return List{[]MalType{Symbol{"quote", nil}, form}, nil}, nil
 	case "`":
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"quasiquote"}, form}, nil}, nil
+		return List{[]MalType{Symbol{"quasiquote", nil}, form}, nil}, nil
 	case `~`:
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"unquote"}, form}, nil}, nil
+		return List{[]MalType{Symbol{"unquote", nil}, form}, nil}, nil
 	case `~@`:
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"splice-unquote"}, form}, nil}, nil
+		return List{[]MalType{Symbol{"splice-unquote", nil}, form}, nil}, nil
 	case `^`:
 		rdr.next()
 		meta, e := read_form(rdr)
@@ -181,14 +188,14 @@ func read_form(rdr Reader) (MalType, error) {
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"with-meta"}, form, meta}, nil}, nil
+		return List{[]MalType{Symbol{"with-meta", nil}, form, meta}, nil}, nil
 	case `@`:
 		rdr.next()
 		form, e := read_form(rdr)
 		if e != nil {
 			return nil, e
 		}
-		return List{[]MalType{Symbol{"deref"}, form}, nil}, nil
+		return List{[]MalType{Symbol{"deref", nil}, form}, nil}, nil
 
 	// list
 	case ")":
@@ -207,6 +214,10 @@ func read_form(rdr Reader) (MalType, error) {
 		return nil, errors.New("unexpected '}'")
 	case "{":
 		return read_hash_map(rdr)
+
+	// set
+	case "#{":
+		return read_set(rdr)
 	default:
 		return read_atom(rdr)
 	}
@@ -37,23 +37,34 @@ func eval_ast(ast MalType, env EnvType) (MalType, error) {
 		return List{lst, nil}, nil
 	} else if Vector_Q(ast) {
 		lst := []MalType{}
-		for _, a := range ast.(Vector).Val {
+		for _, a := range ast.(Vector).Slice() {
 			exp, e := EVAL(a, env)
 			if e != nil {
 				return nil, e
 			}
 			lst = append(lst, exp)
 		}
-		return Vector{lst, nil}, nil
+		return NewVector(lst...), nil
+	} else if ArrayMap_Q(ast) {
+		m := ast.(ArrayMap)
+		new_am := ArrayMap{}
+		for _, ent := range m.Entries() {
+			kv, e2 := EVAL(ent.Val, env)
+			if e2 != nil {
+				return nil, e2
+			}
+			new_am = new_am.Assoc(ent.Key, kv)
+		}
+		return new_am, nil
 	} else if HashMap_Q(ast) {
 		m := ast.(HashMap)
-		new_hm := HashMap{map[string]MalType{}, nil}
-		for k, v := range m.Val {
-			kv, e2 := EVAL(v, env)
+		new_hm := HashMap{}
+		for _, ent := range m.Entries() {
+			kv, e2 := EVAL(ent.Val, env)
 			if e2 != nil {
 				return nil, e2
 			}
-			new_hm.Val[k] = kv
+			new_hm = new_hm.Assoc(ent.Key, kv)
 		}
 		return new_hm, nil
 	} else {
@@ -191,7 +202,7 @@ func rep(str string) (MalType, error) {
 func main() {
 	// core.go: defined using go
 	for k, v := range core.NS {
-		repl_env.Set(Symbol{k}, v)
+		repl_env.Set(Symbol{k, nil}, v)
 	}
 
 	// core.mal: defined using the language itself
@@ -38,23 +38,34 @@ func eval_ast(ast MalType, env EnvType) (MalType, error) {
 		return List{lst, nil}, nil
 	} else if Vector_Q(ast) {
 		lst := []MalType{}
-		for _, a := range ast.(Vector).Val {
+		for _, a := range ast.(Vector).Slice() {
 			exp, e := EVAL(a, env)
 			if e != nil {
 				return nil, e
 			}
 			lst = append(lst, exp)
 		}
-		return Vector{lst, nil}, nil
+		return NewVector(lst...), nil
+	} else if ArrayMap_Q(ast) {
+		m := ast.(ArrayMap)
+		new_am := ArrayMap{}
+		for _, ent := range m.Entries() {
+			kv, e2 := EVAL(ent.Val, env)
+			if e2 != nil {
+				return nil, e2
+			}
+			new_am = new_am.Assoc(ent.Key, kv)
+		}
+		return new_am, nil
 	} else if HashMap_Q(ast) {
 		m := ast.(HashMap)
-		new_hm := HashMap{map[string]MalType{}, nil}
-		for k, v := range m.Val {
-			kv, e2 := EVAL(v, env)
+		new_hm := HashMap{}
+		for _, ent := range m.Entries() {
+			kv, e2 := EVAL(ent.Val, env)
 			if e2 != nil {
 				return nil, e2
 			}
-			new_hm.Val[k] = kv
+			new_hm = new_hm.Assoc(ent.Key, kv)
 		}
 		return new_hm, nil
 	} else {
@@ -202,12 +213,12 @@ func rep(str string) (MalType, error) {
 func main() {
 	// core.go: defined using go
 	for k, v := range core.NS {
-		repl_env.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+		repl_env.Set(Symbol{k, nil}, Func{v.(func([]MalType) (MalType, error)), nil})
 	}
-	repl_env.Set(Symbol{"eval"}, Func{func(a []MalType) (MalType, error) {
+	repl_env.Set(Symbol{"eval", nil}, Func{func(a []MalType) (MalType, error) {
 		return EVAL(a[0], repl_env)
 	}, nil})
-	repl_env.Set(Symbol{"*ARGV*"}, List{})
+	repl_env.Set(Symbol{"*ARGV*", nil}, List{})
 
 	// core.mal: defined using the language itself
 	rep("(def! not (fn* (a) (if a false true)))")
@@ -219,7 +230,7 @@ func main() {
 		for _, a := range os.Args[2:] {
 			args = append(args, a)
 		}
-		repl_env.Set(Symbol{"*ARGV*"}, List{args, nil})
+		repl_env.Set(Symbol{"*ARGV*", nil}, List{args, nil})
 		if _, e := rep("(load-file \"" + os.Args[1] + "\")"); e != nil {
 			fmt.Printf("Error: %v\n", e)
 			os.Exit(1)
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+import (
+	. "env"
+	"printer"
+	. "types"
+)
+
+// Before it is evaluated, a form is analyzed: macros are expanded once
+// and for all, special forms are turned into the nodes below, and
+// symbols are resolved. A symbol bound by an enclosing fn*, let*,
+// catch* or receive becomes the address of a slot in a frame, a global
+// becomes its cell, and any other symbol is looked up by name in the
+// environment the analysis started from.
+
+// scope is the layout of the frames created for one fn*, let*, catch*
+// or receive: the interned ids of the symbols bound in it, by slot.
+// Once frames of a scope exist it is sealed: code analyzed in it later
+// on (the expansion of a macro defined after the scope was analyzed)
+// can't add slots, and defines new symbols by name instead.
+type scope struct {
+	ids    []int
+	outer  *scope
+	sealed bool
+}
+
+// declare returns the slot of sym, or -1 if a sealed scope has none
+func (sc *scope) declare(sym Symbol) int {
+	id := Intern(sym.Val)
+	for i := len(sc.ids) - 1; i >= 0; i-- {
+		if sc.ids[i] == id {
+			return i
+		}
+	}
+	if sc.sealed {
+		return -1
+	}
+	sc.ids = append(sc.ids, id)
+	return len(sc.ids) - 1
+}
+
+// seal returns a sealed view of sc
+func (sc *scope) seal() *scope {
+	if sc == nil {
+		return nil
+	}
+	return &scope{sc.ids, sc.outer, true}
+}
+
+func (sc *scope) resolve(sym Symbol) (int, int, bool) {
+	id := Intern(sym.Val)
+	for depth := 0; sc != nil; depth, sc = depth+1, sc.outer {
+		for i := len(sc.ids) - 1; i >= 0; i-- {
+			if sc.ids[i] == id {
+				return depth, i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Nodes
+type local_ref struct {
+	sym         Symbol
+	depth, slot int
+}
+
+type global_ref struct {
+	sym  Symbol
+	cell *Cell
+}
+
+type name_ref struct {
+	sym Symbol
+}
+
+// *ENV* and (current-env), the frame the code runs in. A symbol that
+// env-set! adds to a frame is seen by code evaluated in the frame later
+// on, but code that was analyzed before and resolved the symbol to a
+// global only sees it while there is no such global.
+type env_node struct{}
+
+type const_node struct {
+	val MalType
+}
+
+type def_node struct {
+	sym   Symbol
+	meta  MalType // analyzed, or nil
+	val   MalType
+	slot  int // -1 to define sym in the environment by name
+	macro bool
+}
+
+type let_node struct {
+	sc    *scope
+	slots []int
+	inits []MalType
+	body  MalType
+}
+
+type if_node struct {
+	cond, then, els MalType
+}
+
+type do_node struct {
+	forms []MalType
+}
+
+type fn_node struct {
+	sc       *scope
+	params   MalType // as written, for printing
+	slots    []int   // of the parameters
+	width    int     // distinct parameters, the first slots of the frame
+	variadic bool
+	body     MalType
+	form     MalType // the body as written, for printing
+}
+
+type try_node struct {
+	body    MalType
+	sc      *scope // of catch*, nil without it
+	handler MalType
+}
+
+type receive_clause struct {
+	pattern MalType
+	slots   []int // of the symbols bound by the pattern
+	sc      *scope
+	body    MalType
+}
+
+type receive_node struct {
+	clauses []receive_clause
+	after   MalType // the timeout, nil for none
+	timeout MalType // what to do after it
+}
+
+type call_node struct {
+	fn   MalType
+	args []MalType
+	form List // for macros defined after the form was analyzed
+	sc   *scope
+	env  EnvType
+}
+
+// function bodies print as they were written
+func (n *fn_node) String() string {
+	return printer.Pr_str(n.form, true)
+}
+
+func analyze(ast MalType, sc *scope, env EnvType) (MalType, error) {
+	switch a := ast.(type) {
+	case Symbol:
+		return resolve(a, sc, env), nil
+	case LazySeq:
+		lst, e := realize_form(a)
+		if e != nil {
+			return nil, e
+		}
+		return analyze(lst, sc, env)
+	case List:
+		if len(a.Val) == 0 {
+			return &const_node{a}, nil
+		}
+		return analyze_list(a, sc, env)
+	case Vector:
+		elems, e := analyze_all(a.Slice(), sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return NewVector(elems...), nil
+	case ArrayMap:
+		new_am := ArrayMap{}
+		for _, ent := range a.Entries() {
+			val, e := analyze(ent.Val, sc, env)
+			if e != nil {
+				return nil, e
+			}
+			new_am = new_am.Assoc(ent.Key, val)
+		}
+		return new_am, nil
+	case HashMap:
+		new_hm := HashMap{}
+		for _, ent := range a.Entries() {
+			val, e := analyze(ent.Val, sc, env)
+			if e != nil {
+				return nil, e
+			}
+			new_hm = new_hm.Assoc(ent.Key, val)
+		}
+		return new_hm, nil
+	case Set:
+		elems, e := analyze_all(a.Elements(), sc, env)
+		if e != nil {
+			return nil, e
+		}
+		new_set := NewSet()
+		for _, elem := range elems {
+			new_set = new_set.Conj(elem)
+		}
+		return new_set, nil
+	default:
+		return ast, nil
+	}
+}
+
+func analyze_all(asts []MalType, sc *scope, env EnvType) ([]MalType, error) {
+	nodes := make([]MalType, len(asts))
+	for i, a := range asts {
+		node, e := analyze(a, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+func resolve(sym Symbol, sc *scope, env EnvType) MalType {
+	if depth, slot, ok := sc.resolve(sym); ok {
+		return &local_ref{sym, depth, slot}
+	}
+	if sym.Val == "*ENV*" {
+		return &env_node{}
+	}
+	if root, ok := env.(*Env); ok && root.IsRoot() {
+		return &global_ref{sym, root.Cell(sym)}
+	}
+	return &name_ref{sym}
+}
+
+// lookup_macro returns the macro named by the head of ast, unless it
+// is bound locally
+func lookup_macro(ast MalType, sc *scope, env EnvType) (MalFunc, bool) {
+	lst, ok := ast.(List)
+	if !ok || len(lst.Val) == 0 {
+		return MalFunc{}, false
+	}
+	sym, ok := lst.Val[0].(Symbol)
+	if !ok {
+		return MalFunc{}, false
+	}
+	if _, _, ok := sc.resolve(sym); ok {
+		return MalFunc{}, false
+	}
+	mac, ok := env.Lookup(sym)
+	if fn, is_fn := mac.(MalFunc); ok && is_fn && fn.GetMacro() {
+		return fn, true
+	}
+	return MalFunc{}, false
+}
+
+func expand_macros(ast MalType, sc *scope, env EnvType) (MalType, error) {
+	for {
+		mac, ok := lookup_macro(ast, sc, env)
+		if !ok {
+			return ast, nil
+		}
+		var e error
+		if ast, e = Apply(mac, ast.(List).Val[1:]); e != nil {
+			return nil, e
+		}
+		if ast, e = realize_form(ast); e != nil {
+			return nil, e
+		}
+	}
+}
+
+// realize_form turns a lazy sequence built as code, for instance by
+// map in a macro, into the list it stands for
+func realize_form(ast MalType) (MalType, error) {
+	ls, ok := ast.(LazySeq)
+	if !ok {
+		return ast, nil
+	}
+	slc, e := GetSlice(ls)
+	if e != nil {
+		return nil, e
+	}
+	return List{slc, nil}, nil
+}
+
+func analyze_list(ast List, sc *scope, env EnvType) (MalType, error) {
+	expanded, e := expand_macros(ast, sc, env)
+	if e != nil {
+		return nil, e
+	}
+	if lst, ok := expanded.(List); !ok || len(lst.Val) == 0 {
+		return analyze(expanded, sc, env)
+	}
+	ast = expanded.(List)
+	lst := ast.Val
+	var a1, a2 MalType
+	if len(lst) > 1 {
+		a1 = lst[1]
+	}
+	if len(lst) > 2 {
+		a2 = lst[2]
+	}
+	a0sym := "__<*fn*>__"
+	if Symbol_Q(lst[0]) {
+		a0sym = lst[0].(Symbol).Val
+	}
+	switch a0sym {
+	case "def!", "defmacro!":
+		return analyze_def(a0sym, a1, a2, sc, env)
+	case "let*":
+		return analyze_let(a1, a2, sc, env)
+	case "current-env":
+		return &env_node{}, nil
+	case "quote":
+		return &const_node{a1}, nil
+	case "quasiquoteexpand":
+		return &const_node{quasiquote(a1)}, nil
+	case "quasiquote":
+		return analyze(quasiquote(a1), sc, env)
+	case "macroexpand":
+		exp, e := expand_macros(a1, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &const_node{exp}, nil
+	case "try*":
+		return analyze_try(a1, a2, sc, env)
+	case "receive":
+		return analyze_receive(lst[1:], sc, env)
+	case "do":
+		forms, e := analyze_all(lst[1:], sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &do_node{forms}, nil
+	case "if":
+		nodes, e := analyze_all(lst[1:], sc, env)
+		if e != nil {
+			return nil, e
+		}
+		for len(nodes) < 3 {
+			nodes = append(nodes, nil)
+		}
+		return &if_node{nodes[0], nodes[1], nodes[2]}, nil
+	case "fn*":
+		return analyze_fn(a1, a2, sc, env)
+	default:
+		nodes, e := analyze_all(lst, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &call_node{nodes[0], nodes[1:], ast, sc, env}, nil
+	}
+}
+
+func analyze_def(form string, a1 MalType, a2 MalType, sc *scope, env EnvType) (MalType, error) {
+	var sym Symbol
+	var meta MalType
+	switch s := a1.(type) {
+	case Symbol:
+		sym = s
+	default:
+		// (def! ^{:doc "..."} name ...) reads as (with-meta name {...})
+		slc, e := GetSlice(a1)
+		if e != nil || !List_Q(a1) || len(slc) != 3 || form != "def!" ||
+			!Symbol_Q(slc[0]) || slc[0].(Symbol).Val != "with-meta" || !Symbol_Q(slc[1]) {
+			return nil, errors.New(form + " requires a symbol")
+		}
+		sym = slc[1].(Symbol)
+		if meta, e = analyze(slc[2], sc, env); e != nil {
+			return nil, e
+		}
+	}
+	slot := -1
+	if sc != nil {
+		slot = sc.declare(sym)
+	}
+	val, e := analyze(a2, sc, env)
+	if e != nil {
+		return nil, e
+	}
+	return &def_node{sym, meta, val, slot, form == "defmacro!"}, nil
+}
+
+// declare_defs declares the symbols that def! defines in forms before
+// they are analyzed, so that code in a scope sees its definitions
+// whatever their order. Forms with a scope of their own are skipped,
+// and so are definitions that only macros expand to.
+func declare_defs(sc *scope, forms ...MalType) {
+	for _, form := range forms {
+		lst, ok := form.(List)
+		if !ok || len(lst.Val) == 0 {
+			continue
+		}
+		if head, ok := lst.Val[0].(Symbol); ok {
+			switch head.Val {
+			case "def!", "defmacro!":
+				if sym, ok := def_name(lst.Val[1:]); ok {
+					sc.declare(sym)
+				}
+			case "fn*", "let*", "catch*", "receive", "quote", "quasiquote":
+				continue
+			}
+		}
+		declare_defs(sc, lst.Val...)
+	}
+}
+
+// def_name returns the name in the arguments of a def!, which may
+// carry metadata
+func def_name(args []MalType) (Symbol, bool) {
+	if len(args) == 0 {
+		return Symbol{}, false
+	}
+	if sym, ok := args[0].(Symbol); ok {
+		return sym, true
+	}
+	if lst, ok := args[0].(List); ok && len(lst.Val) == 3 && starts_with(lst.Val, "with-meta") {
+		sym, ok := lst.Val[1].(Symbol)
+		return sym, ok
+	}
+	return Symbol{}, false
+}
+
+// The symbols of a let* are declared before its bindings are analyzed,
+// so that functions bound in it can call each other. Until a slot is
+// bound, the symbol is looked up in the enclosing environments.
+func analyze_let(a1 MalType, a2 MalType, sc *scope, env EnvType) (MalType, error) {
+	binds, e := GetSlice(a1)
+	if e != nil {
+		return nil, e
+	}
+	let_sc := &scope{outer: sc}
+	n := &let_node{sc: let_sc}
+	for i := 0; i < len(binds); i += 2 {
+		sym, ok := binds[i].(Symbol)
+		if !ok {
+			return nil, errors.New("non-symbol bind value")
+		}
+		n.slots = append(n.slots, let_sc.declare(sym))
+	}
+	declare_defs(let_sc, binds...)
+	declare_defs(let_sc, a2)
+	for i := 1; i < len(binds); i += 2 {
+		init, e := analyze(binds[i], let_sc, env)
+		if e != nil {
+			return nil, e
+		}
+		n.inits = append(n.inits, init)
+	}
+	if len(n.inits) < len(n.slots) {
+		return nil, errors.New("let* requires an even number of forms in bindings")
+	}
+	if n.body, e = analyze(a2, let_sc, env); e != nil {
+		return nil, e
+	}
+	return n, nil
+}
+
+func analyze_fn(a1 MalType, a2 MalType, sc *scope, env EnvType) (MalType, error) {
+	params, e := GetSlice(a1)
+	if e != nil {
+		return nil, e
+	}
+	fn_sc := &scope{outer: sc}
+	n := &fn_node{sc: fn_sc, params: a1, form: a2}
+	for i := 0; i < len(params); i++ {
+		sym, ok := params[i].(Symbol)
+		if !ok {
+			return nil, errors.New("fn* parameters must be symbols")
+		}
+		if sym.Val == "&" && i+1 < len(params) {
+			if sym, ok = params[i+1].(Symbol); !ok {
+				return nil, errors.New("fn* parameters must be symbols")
+			}
+			n.variadic = true
+			n.slots = append(n.slots, fn_sc.declare(sym))
+			break
+		}
+		n.slots = append(n.slots, fn_sc.declare(sym))
+	}
+	for _, slot := range n.slots {
+		n.width = max(n.width, slot+1)
+	}
+	declare_defs(fn_sc, a2)
+	if n.body, e = analyze(a2, fn_sc, env); e != nil {
+		return nil, e
+	}
+	return n, nil
+}
+
+// bind binds the parameters of a function called with args in a new
+// frame. Unless the caller owns args, the frame gets a copy.
+func (n *fn_node) bind(outer EnvType, args []MalType, owned bool) (*Env, error) {
+	fixed := len(n.slots)
+	if n.variadic {
+		fixed--
+	}
+	if len(args) < fixed {
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of %d)", len(args), fixed)
+	}
+	if !n.variadic && n.width == fixed {
+		slots := args[:fixed]
+		if !owned {
+			slots = append([]MalType{}, slots...)
+		}
+		return NewFrame(outer, n.sc.ids, slots), nil
+	}
+	// a parameter named twice is bound to the last argument
+	slots := make([]MalType, n.width)
+	for i := 0; i < fixed; i++ {
+		slots[n.slots[i]] = args[i]
+	}
+	if n.variadic {
+		slots[n.slots[fixed]] = List{args[fixed:], nil}
+	}
+	return NewFrame(outer, n.sc.ids, slots), nil
+}
+
+func (n *fn_node) gen_env(outer EnvType, _ MalType, args MalType) (EnvType, error) {
+	return n.bind(outer, args.(List).Val, false)
+}
+
+func analyze_try(a1 MalType, a2 MalType, sc *scope, env EnvType) (MalType, error) {
+	body, e := analyze(a1, sc, env)
+	if e != nil {
+		return nil, e
+	}
+	n := &try_node{body: body}
+	if lst, ok := a2.(List); ok && starts_with(lst.Val, "catch*") {
+		if len(lst.Val) != 3 || !Symbol_Q(lst.Val[1]) {
+			return nil, errors.New("catch* requires a symbol and a body")
+		}
+		n.sc = &scope{outer: sc}
+		n.sc.declare(lst.Val[1].(Symbol))
+		declare_defs(n.sc, lst.Val[2])
+		if n.handler, e = analyze(lst.Val[2], n.sc, env); e != nil {
+			return nil, e
+		}
+	}
+	return n, nil
+}
+
+// (receive pattern body ... :after ms body)
+func analyze_receive(clauses []MalType, sc *scope, env EnvType) (MalType, error) {
+	n := &receive_node{}
+	if l := len(clauses); l >= 3 && clauses[l-3] == "\u029eafter" {
+		nodes, e := analyze_all(clauses[l-2:], sc, env)
+		if e != nil {
+			return nil, e
+		}
+		n.after, n.timeout = nodes[0], nodes[1]
+		clauses = clauses[:l-3]
+	}
+	if len(clauses)%2 == 1 {
+		return nil, errors.New("receive requires pattern and body pairs")
+	}
+	for i := 0; i < len(clauses); i += 2 {
+		c := receive_clause{pattern: clauses[i], sc: &scope{outer: sc}}
+		for _, sym := range pattern_symbols(clauses[i], nil) {
+			c.slots = append(c.slots, c.sc.declare(sym))
+		}
+		declare_defs(c.sc, clauses[i+1])
+		body, e := analyze(clauses[i+1], c.sc, env)
+		if e != nil {
+			return nil, e
+		}
+		c.body = body
+		n.clauses = append(n.clauses, c)
+	}
+	return n, nil
+}
+
+// pattern_symbols lists the symbols bound by a receive pattern, in the
+// order MatchPattern binds them
+func pattern_symbols(pattern MalType, syms []Symbol) []Symbol {
+	switch p := pattern.(type) {
+	case Symbol:
+		if p.Val != "_" {
+			syms = append(syms, p)
+		}
+	case List, Vector:
+		ps, _ := GetSlice(p)
+		for i, elem := range ps {
+			if s, ok := elem.(Symbol); ok && s.Val == "&" && i+1 < len(ps) {
+				return pattern_symbols(ps[i+1], syms)
+			}
+			syms = pattern_symbols(elem, syms)
+		}
+	}
+	return syms
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 )
 
 import (
@@ -40,12 +41,12 @@ func qq_loop(xs []MalType) MalType {
 		switch e := elt.(type) {
 		case List:
 			if starts_with(e.Val, "splice-unquote") {
-				acc = NewList(Symbol{"concat"}, e.Val[1], acc)
+				acc = NewList(Symbol{"concat", nil}, e.Val[1], acc)
 				continue
 			}
 		default:
 		}
-		acc = NewList(Symbol{"cons"}, quasiquote(elt), acc)
+		acc = NewList(Symbol{"cons", nil}, quasiquote(elt), acc)
 	}
 	return acc
 }
@@ -53,9 +54,9 @@ func qq_loop(xs []MalType) MalType {
 func quasiquote(ast MalType) MalType {
 	switch a := ast.(type) {
 	case Vector:
-		return NewList(Symbol{"vec"}, qq_loop(a.Val))
-	case HashMap, Symbol:
-		return NewList(Symbol{"quote"}, ast)
+		return NewList(Symbol{"vec", nil}, qq_loop(a.Slice()))
+	case HashMap, ArrayMap, Set, Symbol:
+		return NewList(Symbol{"quote", nil}, ast)
 	case List:
 		if starts_with(a.Val,"unquote") {
 			return a.Val[1]
@@ -67,244 +68,282 @@ func quasiquote(ast MalType) MalType {
 	}
 }
 
-func is_macro_call(ast MalType, env EnvType) bool {
-	if List_Q(ast) {
-		slc, _ := GetSlice(ast)
-		if len(slc) == 0 {
-			return false
-		}
-		a0 := slc[0]
-		if Symbol_Q(a0) && env.Find(a0.(Symbol)) != nil {
-			mac, e := env.Get(a0.(Symbol))
-			if e != nil {
-				return false
-			}
-			if MalFunc_Q(mac) {
-				return mac.(MalFunc).GetMacro()
+// EVAL analyzes ast, then evaluates it. A do at the top level, which is
+// how load-file reads a file, is analyzed one form at a time, so that
+// macros defined by a form apply to the next ones.
+func EVAL(ast MalType, env EnvType) (MalType, error) {
+	ast, e := expand_macros(ast, nil, env)
+	if e != nil {
+		return nil, e
+	}
+	if lst, ok := ast.(List); ok && starts_with(lst.Val, "do") {
+		var res MalType
+		for _, form := range lst.Val[1:] {
+			if res, e = EVAL(form, env); e != nil {
+				return nil, e
 			}
 		}
+		return res, nil
 	}
-	return false
-}
-
-func macroexpand(ast MalType, env EnvType) (MalType, error) {
-	var mac MalType
-	var e error
-	for is_macro_call(ast, env) {
-		slc, _ := GetSlice(ast)
-		a0 := slc[0]
-		mac, e = env.Get(a0.(Symbol))
-		if e != nil {
-			return nil, e
-		}
-		fn := mac.(MalFunc)
-		ast, e = Apply(fn, slc[1:])
-		if e != nil {
-			return nil, e
-		}
+	node, e := analyze(ast, nil, env)
+	if e != nil {
+		return nil, e
 	}
-	return ast, nil
+	return eval(node, env)
 }
 
 func eval_ast(ast MalType, env EnvType) (MalType, error) {
 	//fmt.Printf("eval_ast: %#v\n", ast)
-	if Symbol_Q(ast) {
-		return env.Get(ast.(Symbol))
-	} else if List_Q(ast) {
+	if Vector_Q(ast) {
 		lst := []MalType{}
-		for _, a := range ast.(List).Val {
-			exp, e := EVAL(a, env)
+		for _, a := range ast.(Vector).Slice() {
+			exp, e := eval(a, env)
 			if e != nil {
 				return nil, e
 			}
 			lst = append(lst, exp)
 		}
-		return List{lst, nil}, nil
-	} else if Vector_Q(ast) {
-		lst := []MalType{}
-		for _, a := range ast.(Vector).Val {
-			exp, e := EVAL(a, env)
-			if e != nil {
-				return nil, e
+		return NewVector(lst...), nil
+	} else if ArrayMap_Q(ast) {
+		m := ast.(ArrayMap)
+		new_am := ArrayMap{}
+		for _, ent := range m.Entries() {
+			kv, e2 := eval(ent.Val, env)
+			if e2 != nil {
+				return nil, e2
 			}
-			lst = append(lst, exp)
+			new_am = new_am.Assoc(ent.Key, kv)
 		}
-		return Vector{lst, nil}, nil
+		return new_am, nil
 	} else if HashMap_Q(ast) {
 		m := ast.(HashMap)
-		new_hm := HashMap{map[string]MalType{}, nil}
-		for k, v := range m.Val {
-			kv, e2 := EVAL(v, env)
+		new_hm := HashMap{}
+		for _, ent := range m.Entries() {
+			kv, e2 := eval(ent.Val, env)
 			if e2 != nil {
 				return nil, e2
 			}
-			new_hm.Val[k] = kv
+			new_hm = new_hm.Assoc(ent.Key, kv)
 		}
 		return new_hm, nil
+	} else if Set_Q(ast) {
+		new_set := NewSet()
+		for _, a := range ast.(Set).Elements() {
+			exp, e := eval(a, env)
+			if e != nil {
+				return nil, e
+			}
+			new_set = new_set.Conj(exp)
+		}
+		return new_set, nil
 	} else {
 		return ast, nil
 	}
 }
 
-func EVAL(ast MalType, env EnvType) (MalType, error) {
-	var e error
-	for {
+// the body of a function, for Apply
+func eval_fn(exp MalType, env EnvType) (MalType, error) {
+	return eval(exp.(*fn_node).body, env)
+}
 
-		//fmt.Printf("EVAL: %v\n", printer.Pr_str(ast, true))
-		switch ast.(type) {
-		case List: // continue
-		default:
-			return eval_ast(ast, env)
-		}
+// frame_at returns the frame depth levels out of env, or false if
+// the environments are not all frames, as when code is evaluated in
+// another implementation of EnvType: symbols are then looked up by
+// name instead
+func frame_at(env EnvType, depth int) (*Env, bool) {
+	frame, ok := env.(*Env)
+	if !ok {
+		return nil, false
+	}
+	return frame.Up(depth)
+}
 
-		// apply list
-		ast, e = macroexpand(ast, env)
-		if e != nil {
-			return nil, e
-		}
-		if !List_Q(ast) {
-			return eval_ast(ast, env)
-		}
-		if len(ast.(List).Val) == 0 {
-			return ast, nil
-		}
+// eval evaluates analyzed code
+func eval(ast MalType, env EnvType) (MalType, error) {
+	for {
 
-		a0 := ast.(List).Val[0]
-		var a1 MalType = nil
-		var a2 MalType = nil
-		switch len(ast.(List).Val) {
-		case 1:
-			a1 = nil
-			a2 = nil
-		case 2:
-			a1 = ast.(List).Val[1]
-			a2 = nil
-		default:
-			a1 = ast.(List).Val[1]
-			a2 = ast.(List).Val[2]
-		}
-		a0sym := "__<*fn*>__"
-		if Symbol_Q(a0) {
-			a0sym = a0.(Symbol).Val
-		}
-		switch a0sym {
-		case "def!":
-			res, e := EVAL(a2, env)
-			if e != nil {
-				return nil, e
+		switch n := ast.(type) {
+		case *local_ref:
+			frame, ok := frame_at(env, n.depth)
+			if !ok {
+				return env.Get(n.sym)
 			}
-			return env.Set(a1.(Symbol), res), nil
-		case "let*":
-			let_env, e := NewEnv(env, nil, nil)
-			if e != nil {
-				return nil, e
+			if val, ok := frame.Slot(n.slot); ok {
+				return val, nil
+			}
+			return frame.Outer().Get(n.sym)
+		case *global_ref:
+			if val, ok := n.cell.Get(); ok {
+				return val, nil
 			}
-			arr1, e := GetSlice(a1)
+			// it may have been defined by name in a frame since
+			return env.Get(n.sym)
+		case *name_ref:
+			return env.Get(n.sym)
+		case *env_node:
+			return env, nil
+		case *const_node:
+			return n.val, nil
+		case *def_node:
+			res, e := eval(n.val, env)
 			if e != nil {
 				return nil, e
 			}
-			for i := 0; i < len(arr1); i += 2 {
-				if !Symbol_Q(arr1[i]) {
-					return nil, errors.New("non-symbol bind value")
+			if n.macro {
+				fn, ok := res.(MalFunc)
+				if !ok {
+					return nil, errors.New("defmacro! requires a function")
 				}
-				exp, e := EVAL(arr1[i+1], let_env)
+				res = fn.SetMacro()
+			}
+			// the metadata of the name goes to a copy of the value;
+			// numbers, strings and the like have none and it is
+			// dropped, while references (atoms...) can't be copied
+			// and changing theirs would change it for every name
+			if n.meta != nil {
+				meta, e := eval(n.meta, env)
+				if e != nil {
+					return nil, e
+				}
+				if with_meta, e := WithMeta(res, meta); e == nil {
+					res = with_meta
+				} else if _, e := GetMeta(res); e == nil {
+					return nil, errors.New("def! can't put metadata on " +
+						TypeName(res) + ", use alter-meta!")
+				}
+			}
+			if frame, ok := env.(*Env); ok && n.slot >= 0 && frame.SetSlot(n.slot, res) {
+				return res, nil
+			}
+			return env.Set(n.sym, res), nil
+		case *let_node:
+			let_env := NewFrame(env, n.sc.ids, nil)
+			for i, init := range n.inits {
+				exp, e := eval(init, let_env)
 				if e != nil {
 					return nil, e
 				}
-				let_env.Set(arr1[i].(Symbol), exp)
+				let_env.SetSlot(n.slots[i], exp)
 			}
-			ast = a2
+			ast = n.body
 			env = let_env
-		case "quote":
-			return a1, nil
-		case "quasiquoteexpand":
-			return quasiquote(a1), nil
-		case "quasiquote":
-			ast = quasiquote(a1)
-		case "defmacro!":
-			fn, e := EVAL(a2, env)
-			fn = fn.(MalFunc).SetMacro()
-			if e != nil {
-				return nil, e
+		case *try_node:
+			exp, e := eval(n.body, env)
+			if ls, ok := exp.(LazySeq); ok && e == nil {
+				// so that an error producing the first element is caught
+				_, e = ls.Empty()
+			}
+			if e == nil || n.sc == nil {
+				return exp, e
 			}
-			return env.Set(a1.(Symbol), fn), nil
-		case "macroexpand":
-			return macroexpand(a1, env)
-		case "try*":
 			var exc MalType
-			exp, e := EVAL(a1, env)
-			if e == nil {
-				return exp, nil
-			} else {
-				if a2 != nil && List_Q(a2) {
-					a2s, _ := GetSlice(a2)
-					if Symbol_Q(a2s[0]) && (a2s[0].(Symbol).Val == "catch*") {
-						switch e.(type) {
-						case MalError:
-							exc = e.(MalError).Obj
-						default:
-							exc = e.Error()
-						}
-						binds := NewList(a2s[1])
-						new_env, e := NewEnv(env, binds, NewList(exc))
-						if e != nil {
-							return nil, e
-						}
-						exp, e = EVAL(a2s[2], new_env)
-						if e == nil {
-							return exp, nil
-						}
+			switch e.(type) {
+			case MalError:
+				exc = e.(MalError).Obj
+			default:
+				exc = e.Error()
+			}
+			return eval(n.handler, NewFrame(env, n.sc.ids, []MalType{exc}))
+		case *receive_node:
+			timeout := time.Duration(-1)
+			if n.after != nil {
+				ms, e := eval(n.after, env)
+				if e != nil {
+					return nil, e
+				}
+				if _, ok := ms.(int); !ok {
+					return nil, errors.New("receive :after requires a number of milliseconds")
+				}
+				timeout = time.Duration(ms.(int)) * time.Millisecond
+			}
+			msg, clause, ok := Self().Receive(func(msg MalType) int {
+				for i, c := range n.clauses {
+					if _, _, ok := MatchPattern(c.pattern, msg); ok {
+						return i
 					}
 				}
-				return nil, e
+				return -1
+			}, timeout)
+			if !ok {
+				ast = n.timeout
+				break
 			}
-		case "do":
-			lst := ast.(List).Val
-			_, e := eval_ast(List{lst[1 : len(lst)-1], nil}, env)
-			if e != nil {
-				return nil, e
+			c := n.clauses[clause]
+			_, vals, _ := MatchPattern(c.pattern, msg)
+			// the slots past those of the pattern are left unbound
+			bound := 0
+			for _, slot := range c.slots {
+				bound = max(bound, slot+1)
+			}
+			slots := make([]MalType, bound)
+			for i, val := range vals {
+				slots[c.slots[i]] = val
 			}
-			if len(lst) == 1 {
+			env = NewFrame(env, c.sc.ids, slots)
+			ast = c.body
+		case *do_node:
+			if len(n.forms) == 0 {
 				return nil, nil
 			}
-			ast = lst[len(lst)-1]
-		case "if":
-			cond, e := EVAL(a1, env)
+			for _, form := range n.forms[:len(n.forms)-1] {
+				if _, e := eval(form, env); e != nil {
+					return nil, e
+				}
+			}
+			ast = n.forms[len(n.forms)-1]
+		case *if_node:
+			cond, e := eval(n.cond, env)
 			if e != nil {
 				return nil, e
 			}
 			if cond == nil || cond == false {
-				if len(ast.(List).Val) >= 4 {
-					ast = ast.(List).Val[3]
-				} else {
-					return nil, nil
-				}
+				ast = n.els
 			} else {
-				ast = a2
+				ast = n.then
 			}
-		case "fn*":
-			fn := MalFunc{EVAL, a2, env, a1, false, NewEnv, nil}
-			return fn, nil
-		default:
-			el, e := eval_ast(ast, env)
+		case *fn_node:
+			return MalFunc{eval_fn, n, env, n.params, false, n.gen_env, nil}, nil
+		case *call_node:
+			f, e := eval(n.fn, env)
 			if e != nil {
 				return nil, e
 			}
-			f := el.(List).Val[0]
-			if MalFunc_Q(f) {
-				fn := f.(MalFunc)
-				ast = fn.Exp
-				env, e = NewEnv(fn.Env, fn.Params, List{el.(List).Val[1:], nil})
+			if mac, ok := f.(MalFunc); ok && mac.GetMacro() {
+				// a macro defined after the form was analyzed
+				exp, e := Apply(mac, n.form.Val[1:])
 				if e != nil {
 					return nil, e
 				}
-			} else {
-				fn, ok := f.(Func)
+				if ast, e = analyze(exp, n.sc.seal(), n.env); e != nil {
+					return nil, e
+				}
+				continue
+			}
+			args := make([]MalType, len(n.args))
+			for i, arg := range n.args {
+				if args[i], e = eval(arg, env); e != nil {
+					return nil, e
+				}
+			}
+			switch fn := f.(type) {
+			case MalFunc:
+				fn_n, ok := fn.Exp.(*fn_node)
 				if !ok {
-					return nil, errors.New("attempt to call non-function")
+					return Apply(fn, args)
+				}
+				if env, e = fn_n.bind(fn.Env, args, true); e != nil {
+					return nil, e
 				}
-				return fn.Fn(el.(List).Val[1:])
+				ast = fn_n.body
+			case Func:
+				return fn.Fn(args)
+			case *MultiFn:
+				return fn.Fn(args)
+			default:
+				return nil, errors.New("attempt to call non-function")
 			}
+		default:
+			return eval_ast(ast, env)
 		}
 
 	} // TCO loop
@@ -312,6 +351,12 @@ func EVAL(ast MalType, env EnvType) (MalType, error) {
 
 // print
 func PRINT(exp MalType) (string, error) {
+	// realize lazy sequences here, where errors can be reported
+	if ls, ok := exp.(LazySeq); ok {
+		if _, e := GetSlice(ls); e != nil {
+			return "", e
+		}
+	}
 	return printer.Pr_str(exp, true), nil
 }
 
@@ -334,21 +379,51 @@ func rep(str string) (MalType, error) {
 	return res, nil
 }
 
-func main() {
+func setup() {
 	// core.go: defined using go
 	for k, v := range core.NS {
-		repl_env.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+		repl_env.Set(Symbol{k, nil}, Func{v.(func([]MalType) (MalType, error)), nil})
 	}
-	repl_env.Set(Symbol{"eval"}, Func{func(a []MalType) (MalType, error) {
-		return EVAL(a[0], repl_env)
+	// (eval form) or (eval form env)
+	repl_env.Set(Symbol{"eval", nil}, Func{func(a []MalType) (MalType, error) {
+		switch len(a) {
+		case 1:
+			return EVAL(a[0], repl_env)
+		case 2:
+			env, ok := a[1].(EnvType)
+			if !ok {
+				return nil, errors.New("eval requires an environment")
+			}
+			return EVAL(a[0], env)
+		}
+		return nil, fmt.Errorf("wrong number of arguments (%d instead of 1 or 2)", len(a))
 	}, nil})
-	repl_env.Set(Symbol{"*ARGV*"}, List{})
+	repl_env.Set(Symbol{"*ARGV*", nil}, List{})
 
 	// core.mal: defined using the language itself
 	rep("(def! *host-language* \"go\")")
 	rep("(def! not (fn* (a) (if a false true)))")
 	rep("(def! load-file (fn* (f) (eval (read-string (str \"(do \" (slurp f) \"\nnil)\")))))")
+	rep("(defmacro! dosync (fn* (& body) `(dosync* (fn* () (do ~@body)))))")
+	rep("(defmacro! future (fn* (& body) `(future-call (fn* () (do ~@body)))))")
+	rep("(defmacro! delay (fn* (& body) `(delay* (fn* () (do ~@body)))))")
+	rep("(defmacro! go (fn* (& body) `(go* (fn* () (do ~@body)))))")
+	rep("(defmacro! pvalues (fn* (& exprs) `(pcalls ~@(map (fn* (e) `(fn* () ~e)) exprs))))")
+	rep("(defmacro! lazy-seq (fn* (& body) `(lazy-seq* (fn* () (do ~@body)))))")
+	rep("(defmacro! defrecord (fn* (name fields) `(do (def! ~(symbol (str \"->\" name)) (record-constructor* ~(str name) '~fields true)) (def! ~(symbol (str \"map->\" name)) (map-record-constructor* ~(str name))) '~name)))")
+	rep("(defmacro! deftype (fn* (name fields) `(do (def! ~(symbol (str \"->\" name)) (record-constructor* ~(str name) '~fields false)) '~name)))")
+	rep("(defmacro! defprotocol (fn* (name & sigs) `(do (def! ~name (protocol* ~(str name) '~(map first sigs))) ~@(map (fn* (sig) `(def! ~(first sig) (protocol-method* ~name ~(str (first sig))))) sigs) '~name)))")
+	rep("(defmacro! extend-type (fn* (t & specs) `(extend-type* '~t ~@(map (fn* (s) (if (list? s) `(list ~(str (first s)) (fn* ~(nth s 1) (do ~@(rest (rest s))))) s)) specs))))")
+	rep("(defmacro! extend-protocol (fn* (p & specs) `(extend-protocol* ~p ~@(map (fn* (s) (if (list? s) `(list ~(str (first s)) (fn* ~(nth s 1) (do ~@(rest (rest s))))) `'~s)) specs))))")
+	rep("(defmacro! defmulti (fn* (name dispatch & opts) `(def! ~name (multi-fn* ~(str name) ~dispatch ~(if (= (first opts) :default) (nth opts 1) :default)))))")
+	rep("(defmacro! defmethod (fn* (name dv params & body) `(add-method* ~name ~dv (fn* ~params (do ~@body)))))")
 	rep("(defmacro! cond (fn* (& xs) (if (> (count xs) 0) (list 'if (first xs) (if (> (count xs) 1) (nth xs 1) (throw \"odd number of forms to cond\")) (cons 'cond (rest (rest xs)))))))")
+}
+
+func main() {
+	setup()
+	// the REPL, or the script, keeps its process until the end
+	Adopt()
 
 	// called with mal script to load and eval
 	if len(os.Args) > 1 {
@@ -356,7 +431,7 @@ func main() {
 		for _, a := range os.Args[2:] {
 			args = append(args, a)
 		}
-		repl_env.Set(Symbol{"*ARGV*"}, List{args, nil})
+		repl_env.Set(Symbol{"*ARGV*", nil}, List{args, nil})
 		if _, e := rep("(load-file \"" + os.Args[1] + "\")"); e != nil {
 			fmt.Printf("Error: %v\n", e)
 			os.Exit(1)
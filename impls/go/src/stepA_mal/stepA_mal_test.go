@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+import (
+	. "env"
+	. "types"
+)
+
+// The bodies of tests/perf1.mal, perf2.mal and perf3.mal, as functions
+// called once per iteration. Run from src with
+//   go test -run XX -bench . stepA_mal
+
+func TestMain(m *testing.M) {
+	setup()
+	// the perf tests load their libraries relative to tests/
+	if e := os.Chdir("../../../../tests"); e != nil {
+		panic(e)
+	}
+	for _, f := range []string{"../lib/load-file-once.mal", "../lib/threading.mal",
+		"../lib/perf.mal", "../lib/test_cascade.mal", "../tests/computations.mal"} {
+		if _, e := rep("(load-file \"" + f + "\")"); e != nil {
+			panic(e)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// an environment that isn't an Env: constants over the REPL
+// environment, which definitions go to
+type constants map[string]MalType
+
+func (c constants) Lookup(key Symbol) (MalType, bool) {
+	if val, ok := c[key.Val]; ok {
+		return val, true
+	}
+	return repl_env.Lookup(key)
+}
+
+func (c constants) Find(key Symbol) EnvType {
+	if _, ok := c[key.Val]; ok {
+		return c
+	}
+	return repl_env.Find(key)
+}
+
+func (c constants) Set(key Symbol, value MalType) MalType {
+	return repl_env.Set(key, value)
+}
+
+func (c constants) Get(key Symbol) (MalType, error) {
+	return Get(c, key)
+}
+
+func (c constants) Outer() EnvType {
+	return repl_env
+}
+
+func TestCustomEnv(t *testing.T) {
+	env := constants{"pi": 3}
+	for src, want := range map[string]MalType{
+		"pi":                                   3,
+		"((fn* [x] (+ x pi)) 1)":               4,
+		"(let* [a 1] (do (def! b 2) (+ a b)))": 3,
+		"(do (def! custom-x pi) (let* [y pi] y))":    3,
+		"((fn* [f] (f 2)) (fn* [z] (let* [w z] w)))": 2,
+	} {
+		ast, _ := READ(src)
+		if val, e := EVAL(ast, env); e != nil || val != want {
+			t.Errorf("%s is %v (%v) instead of %v", src, val, e, want)
+		}
+	}
+	if val, e := repl_env.Get(Symbol{"custom-x", nil}); e != nil || val != 3 {
+		t.Errorf("custom-x is %v (%v)", val, e)
+	}
+}
+
+func bench(b *testing.B, def string) {
+	if _, e := rep(def); e != nil {
+		b.Fatal(e)
+	}
+	call, _ := READ("(perf)")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, e := EVAL(call, repl_env); e != nil {
+			b.Fatal(e)
+		}
+	}
+}
+
+func BenchmarkPerf1(b *testing.B) {
+	bench(b, `(def! perf (fn* () (do
+  (or false nil false nil false nil false nil false nil 4)
+  (cond false 1 nil 2 false 3 nil 4 false 5 nil 6 "else" 7)
+  (-> (list 1 2 3 4 5 6 7 8 9) rest rest rest rest rest rest first))))`)
+}
+
+func BenchmarkPerf2(b *testing.B) {
+	bench(b, `(def! perf (fn* () (do
+  (sumdown 10)
+  (fib 12))))`)
+}
+
+func BenchmarkPerf3(b *testing.B) {
+	rep("(def! atm (atom (list 0 1 2 3 4 5 6 7 8 9)))")
+	bench(b, `(def! perf (fn* []
+      (do
+        (or false nil false nil false nil false nil false nil (first @atm))
+        (cond false 1 nil 2 false 3 nil 4 false 5 nil 6 "else" (first @atm))
+        (-> (deref atm) rest rest rest rest rest rest first)
+        (swap! atm (fn* [a] (concat (rest a) (list (first a))))))))`)
+}
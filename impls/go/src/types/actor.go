@@ -0,0 +1,298 @@
+package types
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actors: processes are goroutines with a mailbox, identified by
+// their *Process (pid). Messages are never lost or reordered between
+// two processes; receive takes the first message in the mailbox that
+// matches one of its patterns and leaves the others. When a process
+// ends, every process linked to it gets [:EXIT pid reason] and every
+// process monitoring it [:DOWN pid reason], where reason is :normal or
+// the value thrown by the crash. Unlike Erlang, a crash never kills
+// linked processes: they always receive the exit as a message.
+type Process struct {
+	id       uint64
+	mu       sync.Mutex // guards the fields below
+	mailbox  []MalType
+	signal   chan struct{} // wakes up a waiting receive
+	links    []*Process
+	monitors []*Process
+	done     bool
+	reason   MalType
+	implicit bool // made by Self, ends with its goroutine
+	Meta     MalType
+}
+
+var process_ids atomic.Uint64
+
+// the process of each goroutine that called Self or was spawned
+var processes = map[int64]*Process{}
+var processes_mu sync.Mutex
+
+// the number of implicit processes in processes
+var implicit_processes atomic.Int64
+
+func new_process() *Process {
+	return &Process{id: process_ids.Add(1), signal: make(chan struct{}, 1)}
+}
+
+func Process_Q(obj MalType) bool {
+	_, ok := obj.(*Process)
+	return ok
+}
+
+func (p *Process) Id() uint64 {
+	return p.id
+}
+
+// Self returns the process of the current goroutine, creating one for
+// goroutines that were not spawned (futures, go blocks...). Such an
+// implicit process ends with its goroutine if the goroutine was started
+// by Go; the REPL keeps its own with Adopt.
+func Self() *Process {
+	gid := goroutine_id()
+	processes_mu.Lock()
+	defer processes_mu.Unlock()
+	p, ok := processes[gid]
+	if !ok {
+		p = new_process()
+		p.implicit = true
+		processes[gid] = p
+		implicit_processes.Add(1)
+	}
+	return p
+}
+
+// Adopt makes the current goroutine a process for good
+func Adopt() *Process {
+	p := Self()
+	processes_mu.Lock()
+	defer processes_mu.Unlock()
+	if p.implicit {
+		p.implicit = false
+		implicit_processes.Add(-1)
+	}
+	return p
+}
+
+// Go runs f on a new goroutine, which ends the process f may have
+// taken with Self when f returns. Every goroutine of the interpreter
+// is started with Go, or by Spawn, so that none leaves a process
+// behind.
+func Go(f func()) {
+	go func() {
+		defer release_self()
+		f()
+	}()
+}
+
+func release_self() {
+	// finding out the goroutine is slow: only do it when needed
+	if implicit_processes.Load() == 0 {
+		return
+	}
+	gid := goroutine_id()
+	processes_mu.Lock()
+	p, ok := processes[gid]
+	ok = ok && p.implicit
+	if ok {
+		delete(processes, gid)
+		implicit_processes.Add(-1)
+	}
+	processes_mu.Unlock()
+	if ok {
+		p.exit("\u029enormal")
+	}
+}
+
+// Spawn runs f with args in a new process. With link, the new process
+// is linked to the current one before it starts.
+func Spawn(f MalType, args []MalType, link bool) *Process {
+	p := new_process()
+	if link {
+		Self().Link(p)
+	}
+	go func() {
+		gid := goroutine_id()
+		processes_mu.Lock()
+		processes[gid] = p
+		processes_mu.Unlock()
+		_, e := Apply(f, args)
+		processes_mu.Lock()
+		delete(processes, gid)
+		processes_mu.Unlock()
+		var reason MalType = "\u029enormal"
+		switch e := e.(type) {
+		case nil:
+		case MalError:
+			reason = e.Obj
+		default:
+			reason = e.Error()
+		}
+		p.exit(reason)
+	}()
+	return p
+}
+
+func (p *Process) exit(reason MalType) {
+	p.mu.Lock()
+	p.done = true
+	p.reason = reason
+	links, monitors := p.links, p.monitors
+	p.links, p.monitors = nil, nil
+	p.mu.Unlock()
+	for _, l := range links {
+		l.unlink(p)
+		l.Send(NewVector("\u029eEXIT", p, reason))
+	}
+	for _, m := range monitors {
+		m.Send(NewVector("\u029eDOWN", p, reason))
+	}
+}
+
+func (p *Process) Alive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.done
+}
+
+// Send adds msg to the mailbox; messages to ended processes are
+// dropped
+func (p *Process) Send(msg MalType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.mailbox = append(p.mailbox, msg)
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// add other to the list, or return its exit reason if it has ended
+func (p *Process) watch(other *Process, list *[]*Process) (MalType, bool) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	if other.done {
+		return other.reason, false
+	}
+	*list = append(*list, p)
+	return nil, true
+}
+
+// Link links p and other both ways
+func (p *Process) Link(other *Process) {
+	if p == other {
+		return
+	}
+	if reason, ok := p.watch(other, &other.links); !ok {
+		p.Send(NewVector("\u029eEXIT", other, reason))
+		return
+	}
+	p.mu.Lock()
+	p.links = append(p.links, other)
+	p.mu.Unlock()
+}
+
+func (p *Process) unlink(other *Process) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, l := range p.links {
+		if l == other {
+			p.links = append(p.links[:i:i], p.links[i+1:]...)
+			return
+		}
+	}
+}
+
+// Monitor makes p notified when other ends
+func (p *Process) Monitor(other *Process) {
+	if reason, ok := p.watch(other, &other.monitors); !ok {
+		p.Send(NewVector("\u029eDOWN", other, reason))
+	}
+}
+
+// Receive removes and returns the first message for which match does
+// not return -1, along with that result. It waits for one at most
+// timeout, unless timeout is negative, and returns false if none came.
+func (p *Process) Receive(match func(MalType) int, timeout time.Duration) (MalType, int, bool) {
+	var deadline <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	scanned := 0
+	for {
+		p.mu.Lock()
+		for i := scanned; i < len(p.mailbox); i++ {
+			msg := p.mailbox[i]
+			if clause := match(msg); clause >= 0 {
+				p.mailbox = append(p.mailbox[:i:i], p.mailbox[i+1:]...)
+				p.mu.Unlock()
+				return msg, clause, true
+			}
+		}
+		scanned = len(p.mailbox)
+		p.mu.Unlock()
+		select {
+		case <-p.signal:
+		case <-deadline:
+			return nil, -1, false
+		}
+	}
+}
+
+// MatchPattern matches val against a receive pattern: _ matches
+// anything, other symbols match anything and are bound to it, vectors
+// and lists match sequences element by element (with & binding the
+// rest), and any other pattern matches equal values. It returns the
+// bound symbols and their values.
+func MatchPattern(pattern MalType, val MalType) ([]MalType, []MalType, bool) {
+	syms, vals := []MalType{}, []MalType{}
+	if !match_pattern(pattern, val, &syms, &vals) {
+		return nil, nil, false
+	}
+	return syms, vals, true
+}
+
+func match_pattern(pattern MalType, val MalType, syms *[]MalType, vals *[]MalType) bool {
+	switch pat := pattern.(type) {
+	case Symbol:
+		if pat.Val != "_" {
+			*syms = append(*syms, pat)
+			*vals = append(*vals, val)
+		}
+		return true
+	case List, Vector:
+		if !Sequential_Q(val) {
+			return false
+		}
+		ps, _ := GetSlice(pat)
+		vs, e := GetSlice(val)
+		if e != nil {
+			return false
+		}
+		for i, p := range ps {
+			if s, ok := p.(Symbol); ok && s.Val == "&" && i+1 < len(ps) {
+				rest := []MalType{}
+				if i < len(vs) {
+					rest = vs[i:]
+				}
+				return match_pattern(ps[i+1], List{rest, nil}, syms, vals)
+			}
+			if i >= len(vs) || !match_pattern(p, vs[i], syms, vals) {
+				return false
+			}
+		}
+		return len(ps) == len(vs)
+	default:
+		return Equal_Q(pattern, val)
+	}
+}
@@ -0,0 +1,216 @@
+package types
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Agents: state updated by actions queued with Send and applied one
+// at a time, in order, on a background goroutine. Pooled actions
+// (send) share a pool of runtime.NumCPU() slots; others (send-off) may
+// block and run unrestricted. An action that fails puts the agent in
+// a failed state: the queue is held, further sends are refused, and
+// Restart resumes it. Sends made by an action, or inside a
+// transaction, are held until the action completes or the transaction
+// commits.
+type Agent struct {
+	state   atomic.Pointer[atom_box]
+	mu      sync.Mutex // guards the fields below
+	queue   []agent_action
+	running bool
+	err     error
+	Meta    MalType
+}
+
+type agent_action struct {
+	f      MalType
+	args   []MalType
+	pooled bool
+	done   chan struct{} // await marker instead of an action
+}
+
+var agent_pool = make(chan struct{}, runtime.NumCPU())
+
+// sends held by the action running on each agent goroutine
+var agent_held = map[int64]*[]func(){}
+var agent_held_mu sync.Mutex
+
+// the number of actions running in all agents
+var agent_actions atomic.Int64
+
+// held_sends returns the sends held by the action running on the
+// current goroutine, if any
+func held_sends() (*[]func(), bool) {
+	// finding out the goroutine is slow: only do it when needed
+	if agent_actions.Load() == 0 {
+		return nil, false
+	}
+	agent_held_mu.Lock()
+	defer agent_held_mu.Unlock()
+	held, ok := agent_held[goroutine_id()]
+	return held, ok
+}
+
+func NewAgent(val MalType) *Agent {
+	ag := &Agent{}
+	ag.state.Store(&atom_box{val})
+	return ag
+}
+
+func Agent_Q(obj MalType) bool {
+	_, ok := obj.(*Agent)
+	return ok
+}
+
+func (ag *Agent) Deref() MalType {
+	return ag.state.Load().val
+}
+
+// Failure returns the error that failed the agent, or nil
+func (ag *Agent) Failure() error {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	return ag.err
+}
+
+func (ag *Agent) enqueue(act agent_action) error {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.err != nil {
+		return errors.New("agent is failed, needs restart")
+	}
+	ag.queue = append(ag.queue, act)
+	if !ag.running {
+		ag.running = true
+		Go(ag.run)
+	}
+	return nil
+}
+
+// hold returns false when the send should be dispatched right away
+func hold(send func()) bool {
+	if tx := current_tx(); tx != nil {
+		tx.sends = append(tx.sends, send)
+		return true
+	}
+	if held, ok := held_sends(); ok {
+		*held = append(*held, send)
+		return true
+	}
+	return false
+}
+
+// Send queues f, to be applied to the state and args
+func (ag *Agent) Send(f MalType, args []MalType, pooled bool) error {
+	if e := ag.Failure(); e != nil {
+		return errors.New("agent is failed, needs restart")
+	}
+	act := agent_action{f: f, args: args, pooled: pooled}
+	if hold(func() { ag.enqueue(act) }) {
+		return nil
+	}
+	return ag.enqueue(act)
+}
+
+func (ag *Agent) run() {
+	gid := goroutine_id()
+	for {
+		ag.mu.Lock()
+		if len(ag.queue) == 0 || ag.err != nil {
+			ag.running = false
+			ag.mu.Unlock()
+			return
+		}
+		act := ag.queue[0]
+		ag.queue = ag.queue[1:]
+		ag.mu.Unlock()
+		if act.done != nil {
+			close(act.done)
+			continue
+		}
+		if e := ag.apply(gid, act); e != nil {
+			ag.fail(e)
+		}
+	}
+}
+
+func (ag *Agent) apply(gid int64, act agent_action) error {
+	if act.pooled {
+		agent_pool <- struct{}{}
+		defer func() { <-agent_pool }()
+	}
+	held := []func(){}
+	agent_held_mu.Lock()
+	agent_held[gid] = &held
+	agent_held_mu.Unlock()
+	agent_actions.Add(1)
+	defer func() {
+		agent_held_mu.Lock()
+		delete(agent_held, gid)
+		agent_held_mu.Unlock()
+		agent_actions.Add(-1)
+	}()
+	val, e := Apply(act.f, append([]MalType{ag.Deref()}, act.args...))
+	if e != nil {
+		return e
+	}
+	ag.state.Store(&atom_box{val})
+	for _, send := range held {
+		send()
+	}
+	return nil
+}
+
+// fail records the error and releases anyone awaiting the agent
+func (ag *Agent) fail(e error) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.err = e
+	queue := []agent_action{}
+	for _, act := range ag.queue {
+		if act.done != nil {
+			close(act.done)
+		} else {
+			queue = append(queue, act)
+		}
+	}
+	ag.queue = queue
+}
+
+// Await blocks until the actions sent so far have been applied
+func (ag *Agent) Await() error {
+	if _, in_action := held_sends(); in_action {
+		return errors.New("await: can't await in agent action")
+	}
+	done := make(chan struct{})
+	if e := ag.enqueue(agent_action{done: done}); e != nil {
+		return e
+	}
+	<-done
+	if ag.Failure() != nil {
+		return errors.New("agent is failed, needs restart")
+	}
+	return nil
+}
+
+// Restart clears the failure and sets the state to val, then resumes
+// the held actions unless clear is true
+func (ag *Agent) Restart(val MalType, clear bool) error {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.err == nil {
+		return errors.New("agent does not need a restart")
+	}
+	ag.state.Store(&atom_box{val})
+	ag.err = nil
+	if clear {
+		ag.queue = nil
+	}
+	if len(ag.queue) > 0 && !ag.running {
+		ag.running = true
+		Go(ag.run)
+	}
+	return nil
+}
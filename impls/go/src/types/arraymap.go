@@ -0,0 +1,92 @@
+package types
+
+import (
+	"errors"
+)
+
+// Insertion-ordered map: a hash map from each key to its position in
+// a persistent vector of entries. Dissoc leaves a nil tombstone in
+// the vector, which is compacted once tombstones outnumber entries by
+// more than 8 (so that small maps aren't compacted all the time).
+// Assoc on an existing key keeps its original position.
+type ArrayMap struct {
+	index   HashMap
+	entries Vector
+	Meta    MalType
+}
+
+func NewArrayMap(seq MalType) (MalType, error) {
+	lst, e := GetSlice(seq)
+	if e != nil {
+		return nil, e
+	}
+	if len(lst)%2 == 1 {
+		return nil, errors.New("Odd number of arguments to NewArrayMap")
+	}
+	am := ArrayMap{}
+	for i := 0; i < len(lst); i += 2 {
+		am = am.Assoc(lst[i], lst[i+1])
+	}
+	return am, nil
+}
+
+func ArrayMap_Q(obj MalType) bool {
+	_, ok := obj.(ArrayMap)
+	return ok
+}
+
+func (am ArrayMap) Count() int {
+	return am.index.Count()
+}
+
+func (am ArrayMap) Get(key MalType) (MalType, bool) {
+	idx, ok := am.index.Get(key)
+	if !ok {
+		return nil, false
+	}
+	ent, _ := am.entries.Nth(idx.(int))
+	return ent.(MapEntry).Val, true
+}
+
+func (am ArrayMap) Assoc(key MalType, val MalType) ArrayMap {
+	if idx, ok := am.index.Get(key); ok {
+		ent, _ := am.entries.Nth(idx.(int))
+		am.entries, _ = am.entries.AssocN(idx.(int), MapEntry{ent.(MapEntry).Key, val})
+		return am
+	}
+	am.index = am.index.Assoc(key, am.entries.Count())
+	am.entries = am.entries.Conj(MapEntry{key, val})
+	return am
+}
+
+func (am ArrayMap) Dissoc(key MalType) ArrayMap {
+	idx, ok := am.index.Get(key)
+	if !ok {
+		return am
+	}
+	am.index = am.index.Dissoc(key)
+	am.entries, _ = am.entries.AssocN(idx.(int), nil)
+	if tombstones := am.entries.Count() - am.Count(); tombstones > am.Count()+8 {
+		return am.compact()
+	}
+	return am
+}
+
+func (am ArrayMap) compact() ArrayMap {
+	new_am := ArrayMap{Meta: am.Meta}
+	for _, ent := range am.Entries() {
+		new_am = new_am.Assoc(ent.Key, ent.Val)
+	}
+	return new_am
+}
+
+// Entries returns the entries in insertion order
+func (am ArrayMap) Entries() []MapEntry {
+	entries := make([]MapEntry, 0, am.Count())
+	for _, ent := range am.entries.Slice() {
+		if ent != nil {
+			entries = append(entries, ent.(MapEntry))
+		}
+	}
+	return entries
+}
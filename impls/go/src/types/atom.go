@@ -0,0 +1,149 @@
+package types
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Atoms: the value lives in a box swapped with compare-and-swap, so
+// concurrent updates never interleave. Swap retries its function until
+// no other update got in between; the function may therefore run more
+// than once. A validator can reject a new value, and watches are
+// called after every change with the key, the atom, and the old and
+// new values.
+type Atom struct {
+	box       atomic.Pointer[atom_box]
+	mu        sync.Mutex // guards watches and validator
+	watches   ArrayMap   // key -> fn
+	validator MalType
+	Meta      MalType
+}
+
+type atom_box struct {
+	val MalType
+}
+
+func NewAtom(val MalType) *Atom {
+	a := &Atom{}
+	a.box.Store(&atom_box{val})
+	return a
+}
+
+func Atom_Q(obj MalType) bool {
+	_, ok := obj.(*Atom)
+	return ok
+}
+
+func (a *Atom) Deref() MalType {
+	return a.box.Load().val
+}
+
+func (a *Atom) validate(val MalType) error {
+	a.mu.Lock()
+	validator := a.validator
+	a.mu.Unlock()
+	if validator == nil {
+		return nil
+	}
+	ok, e := Apply(validator, []MalType{val})
+	if e != nil {
+		return e
+	}
+	if ok == nil || ok == false {
+		return errors.New("Invalid reference state")
+	}
+	return nil
+}
+
+func (a *Atom) notify(old MalType, val MalType) error {
+	a.mu.Lock()
+	watches := a.watches.Entries()
+	a.mu.Unlock()
+	for _, w := range watches {
+		if _, e := Apply(w.Val, []MalType{w.Key, a, old, val}); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Swap sets the value to f of the current one and returns the old
+// and the new values
+func (a *Atom) Swap(f func(MalType) (MalType, error)) (MalType, MalType, error) {
+	for {
+		old := a.box.Load()
+		val, e := f(old.val)
+		if e != nil {
+			return nil, nil, e
+		}
+		if e := a.validate(val); e != nil {
+			return nil, nil, e
+		}
+		if a.box.CompareAndSwap(old, &atom_box{val}) {
+			return old.val, val, a.notify(old.val, val)
+		}
+	}
+}
+
+// Reset sets the value and returns the old one
+func (a *Atom) Reset(val MalType) (MalType, error) {
+	if e := a.validate(val); e != nil {
+		return nil, e
+	}
+	old := a.box.Swap(&atom_box{val})
+	return old.val, a.notify(old.val, val)
+}
+
+// CompareAndSet sets the value only if the current one is old itself
+// (see Identical), as in Clojure: an equal copy of it doesn't do
+func (a *Atom) CompareAndSet(old MalType, val MalType) (bool, error) {
+	for {
+		cur := a.box.Load()
+		if !Identical(cur.val, old) {
+			return false, nil
+		}
+		if e := a.validate(val); e != nil {
+			return false, e
+		}
+		if a.box.CompareAndSwap(cur, &atom_box{val}) {
+			return true, a.notify(cur.val, val)
+		}
+	}
+}
+
+func (a *Atom) AddWatch(key MalType, f MalType) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.watches = a.watches.Assoc(key, f)
+}
+
+func (a *Atom) RemoveWatch(key MalType) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.watches = a.watches.Dissoc(key)
+}
+
+// SetValidator installs f (or removes the validator when f is nil),
+// after checking that the current value passes it
+func (a *Atom) SetValidator(f MalType) error {
+	if f != nil {
+		ok, e := Apply(f, []MalType{a.Deref()})
+		if e != nil {
+			return e
+		}
+		if ok == nil || ok == false {
+			return errors.New("Invalid reference state")
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.validator = f
+	return nil
+}
+
+func (a *Atom) Validator() MalType {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.validator
+}
@@ -0,0 +1,180 @@
+package types
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Channels, after core.async: a Go channel plus a closed signal. The
+// Go channel itself is never closed, so that a put racing with Close
+// cannot panic; takers see the signal once the buffer is drained and
+// get nil. nil can't be put on a channel, since it marks the end.
+type Chan struct {
+	ch     chan MalType
+	closed chan struct{}
+	once   sync.Once
+	Meta   MalType
+}
+
+func NewChan(buf int) *Chan {
+	return &Chan{ch: make(chan MalType, buf), closed: make(chan struct{})}
+}
+
+func Chan_Q(obj MalType) bool {
+	_, ok := obj.(*Chan)
+	return ok
+}
+
+func (c *Chan) Close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func (c *Chan) Closed() bool {
+	return is_closed(c.closed)
+}
+
+// Count and Cap describe the buffer
+func (c *Chan) Count() int {
+	return len(c.ch)
+}
+
+func (c *Chan) Cap() int {
+	return cap(c.ch)
+}
+
+// Put blocks until val is taken or buffered, and returns false if the
+// channel is closed
+func (c *Chan) Put(val MalType) (bool, error) {
+	if val == nil {
+		return false, errors.New("can't put nil on a channel")
+	}
+	if c.Closed() {
+		return false, nil
+	}
+	select {
+	case c.ch <- val:
+		return true, nil
+	case <-c.closed:
+		return false, nil
+	}
+}
+
+// Take blocks until a value is available, and returns nil once the
+// channel is closed and drained
+func (c *Chan) Take() MalType {
+	select {
+	case val := <-c.ch:
+		return val
+	case <-c.closed:
+		return c.poll()
+	}
+}
+
+func (c *Chan) poll() MalType {
+	select {
+	case val := <-c.ch:
+		return val
+	default:
+		return nil
+	}
+}
+
+// Timeout returns a channel that closes after d
+func Timeout(d time.Duration) *Chan {
+	c := NewChan(0)
+	time.AfterFunc(d, c.Close)
+	return c
+}
+
+// AltOp is a take from Chan, or a put of Val when Put is true
+type AltOp struct {
+	Chan *Chan
+	Put  bool
+	Val  MalType
+}
+
+// Alts completes exactly one of ops, chosen at random among the ready
+// ones, and returns its result (the value taken, or whether the put
+// succeeded) and its index. Without wait it returns index -1 when no
+// op is ready.
+func Alts(ops []AltOp, wait bool) (MalType, int, error) {
+	cases := []reflect.SelectCase{}
+	for _, op := range ops {
+		if op.Put {
+			if op.Val == nil {
+				return nil, -1, errors.New("can't put nil on a channel")
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend,
+				Chan: reflect.ValueOf(op.Chan.ch), Send: reflect.ValueOf(&op.Val).Elem()})
+		} else {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv,
+				Chan: reflect.ValueOf(op.Chan.ch)})
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv,
+			Chan: reflect.ValueOf(op.Chan.closed)})
+	}
+	if !wait {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	}
+	chosen, recv, _ := reflect.Select(cases)
+	if chosen == len(ops)*2 {
+		return nil, -1, nil
+	}
+	op := ops[chosen/2]
+	switch {
+	case chosen%2 == 1 && op.Put:
+		return false, chosen / 2, nil
+	case chosen%2 == 1:
+		return op.Chan.poll(), chosen / 2, nil
+	case op.Put:
+		return true, chosen / 2, nil
+	default:
+		return recv.Interface(), chosen / 2, nil
+	}
+}
+
+// Pipeline takes values from from, applies f to them with n workers
+// in parallel, and puts the results on to in their original order.
+// Results that are nil are dropped, and so are values for which f
+// fails, after the error is passed to report. When from is closed and
+// drained, to is closed if close_to is true.
+func Pipeline(n int, to *Chan, f MalType, from *Chan, close_to bool, report func(error)) {
+	jobs := make(chan func(), n)
+	results := make(chan chan MalType, n)
+	for i := 0; i < n; i++ {
+		Go(func() {
+			for job := range jobs {
+				job()
+			}
+		})
+	}
+	Go(func() {
+		for val := from.Take(); val != nil; val = from.Take() {
+			res := make(chan MalType, 1)
+			v := val
+			jobs <- func() {
+				out, e := Apply(f, []MalType{v})
+				if e != nil {
+					report(e)
+					out = nil
+				}
+				res <- out
+			}
+			results <- res
+		}
+		close(jobs)
+		close(results)
+	})
+	Go(func() {
+		for res := range results {
+			if out := <-res; out != nil {
+				to.Put(out)
+			}
+		}
+		if close_to {
+			to.Close()
+		}
+	})
+}
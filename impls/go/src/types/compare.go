@@ -0,0 +1,122 @@
+package types
+
+import (
+	"errors"
+	"strings"
+)
+
+// Ordering
+
+// Rank of each kind of value in the total order: values of different
+// kinds compare by rank, values of the same kind by their contents
+func compare_rank(obj MalType) int {
+	switch obj.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int:
+		return 2
+	case string:
+		if Keyword_Q(obj) {
+			return 4
+		}
+		return 3
+	case Symbol:
+		return 5
+	default:
+		if Sequential_Q(obj) {
+			return 6
+		}
+		return -1
+	}
+}
+
+// Compare returns a negative number, zero or a positive number when
+// a is less than, equal to or greater than b. Lists and vectors with
+// equal elements compare equal, consistent with Equal_Q.
+func Compare(a MalType, b MalType) (int, error) {
+	ra := compare_rank(a)
+	rb := compare_rank(b)
+	if ra < 0 || rb < 0 {
+		return 0, errors.New("compare: can't compare " + _obj_type(a) +
+			" with " + _obj_type(b))
+	}
+	if ra != rb {
+		return compare_ints(ra, rb), nil
+	}
+	switch ta := a.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		tb := b.(bool)
+		if ta == tb {
+			return 0, nil
+		} else if tb {
+			return -1, nil
+		}
+		return 1, nil
+	case int:
+		return compare_ints(ta, b.(int)), nil
+	case string:
+		return strings.Compare(ta, b.(string)), nil
+	case Symbol:
+		return strings.Compare(ta.Val, b.(Symbol).Val), nil
+	default:
+		as, e := GetSlice(a)
+		if e != nil {
+			return 0, e
+		}
+		bs, e := GetSlice(b)
+		if e != nil {
+			return 0, e
+		}
+		for i := 0; i < len(as) && i < len(bs); i++ {
+			c, e := Compare(as[i], bs[i])
+			if e != nil || c != 0 {
+				return c, e
+			}
+		}
+		return compare_ints(len(as), len(bs)), nil
+	}
+}
+
+func compare_ints(a int, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// CompareWith orders a and b with a comparator function, or with
+// Compare when cmp is nil. Comparators return a number like Compare,
+// or a boolean meaning "a is less than b".
+func CompareWith(cmp MalType, a MalType, b MalType) (int, error) {
+	if cmp == nil {
+		return Compare(a, b)
+	}
+	res, e := Apply(cmp, []MalType{a, b})
+	if e != nil {
+		return 0, e
+	}
+	switch tres := res.(type) {
+	case int:
+		return tres, nil
+	case bool:
+		if tres {
+			return -1, nil
+		}
+		res, e = Apply(cmp, []MalType{b, a})
+		if e != nil {
+			return 0, e
+		}
+		if True_Q(res) {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, errors.New("comparator must return a number or a boolean")
+	}
+}
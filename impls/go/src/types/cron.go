@@ -0,0 +1,141 @@
+package types
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression: "minute hour day-of-month month
+// day-of-week", in local time. Each field is *, a number, a range a-b,
+// any of those followed by /step, or a comma separated list of them.
+// Days of the week go from 0 (Sunday) to 7 (Sunday again). As in cron,
+// when both day fields are restricted a day matching either one
+// matches. @yearly, @monthly, @weekly, @daily and @hourly are
+// shorthands.
+type Cron struct {
+	Source                        string
+	minute, hour, dom, month, dow uint64 // bit sets
+	dom_any, dow_any              bool
+}
+
+var cron_shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(source string) (*Cron, error) {
+	expr := source
+	if s, ok := cron_shorthands[expr]; ok {
+		expr = s
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression requires 5 fields: " + source)
+	}
+	c := &Cron{Source: source}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		set, e := parse_cron_field(field, bounds[i][0], bounds[i][1])
+		if e != nil {
+			return nil, errors.New(e.Error() + " in cron expression: " + source)
+		}
+		*sets[i] = set
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.dom_any = fields[2] == "*"
+	c.dow_any = fields[4] == "*"
+	return c, nil
+}
+
+func parse_cron_field(field string, min int, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, e := strconv.Atoi(part[i+1:])
+			if e != nil || n <= 0 {
+				return 0, errors.New("invalid step '" + part[i+1:] + "'")
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			ends := strings.SplitN(rng, "-", 2)
+			var e error
+			if lo, e = strconv.Atoi(ends[0]); e != nil {
+				return 0, errors.New("invalid value '" + ends[0] + "'")
+			}
+			hi = lo
+			if len(ends) == 2 {
+				if hi, e = strconv.Atoi(ends[1]); e != nil {
+					return 0, errors.New("invalid value '" + ends[1] + "'")
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, errors.New("value out of range '" + rng + "'")
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *Cron) day_matches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.dom_any && c.dow_any:
+		return true
+	case c.dom_any:
+		return dow
+	case c.dow_any:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next returns the first matching minute after t, or false if there is
+// none in the next five years (like February 30th)
+func (c *Cron) Next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day_matches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Schedule fires at every time matching c
+func Schedule(c *Cron, run func(*Timer)) (*Timer, bool) {
+	first, ok := c.Next(time.Now())
+	if !ok {
+		return nil, false
+	}
+	return StartTimer(run, first, c.Next), true
+}
@@ -0,0 +1,69 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func at(s string) time.Time {
+	t, e := time.ParseInLocation("2006-01-02 15:04:05", s, time.UTC)
+	if e != nil {
+		panic(e)
+	}
+	return t
+}
+
+// 2024-01-01 is a Monday
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2024-01-01 10:07:30", "2024-01-01 10:08:00"},
+		{"*/15 * * * *", "2024-01-01 10:07:00", "2024-01-01 10:15:00"},
+		{"*/15 * * * *", "2024-01-01 10:45:00", "2024-01-01 11:00:00"},
+		{"5-10/2 * * * *", "2024-01-01 10:06:00", "2024-01-01 10:07:00"},
+		{"5-10/2 * * * *", "2024-01-01 10:09:00", "2024-01-01 11:05:00"},
+		{"10/20 * * * *", "2024-01-01 10:31:00", "2024-01-01 10:50:00"},
+		{"0,30 8 * * *", "2024-01-01 08:00:00", "2024-01-01 08:30:00"},
+		{"0 9-17 * * 1-5", "2024-01-05 18:00:00", "2024-01-08 09:00:00"},
+		{"0 0 * * 0", "2024-01-01 00:00:00", "2024-01-07 00:00:00"},
+		{"0 0 * * 7", "2024-01-01 00:00:00", "2024-01-07 00:00:00"},
+		{"0 0 * * 5-7", "2024-01-06 12:00:00", "2024-01-07 00:00:00"},
+		// both day fields restricted: the 13th or a Friday
+		{"0 0 13 * 5", "2024-01-01 00:00:00", "2024-01-05 00:00:00"},
+		{"0 0 13 * 5", "2024-01-12 00:00:00", "2024-01-13 00:00:00"},
+		{"0 0 13 * *", "2024-01-01 00:00:00", "2024-01-13 00:00:00"},
+		{"0 12 * 3 *", "2024-01-01 00:00:00", "2024-03-01 12:00:00"},
+		{"@monthly", "2024-01-31 12:00:00", "2024-02-01 00:00:00"},
+		{"@weekly", "2024-01-03 00:00:00", "2024-01-07 00:00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00:00"},
+		{"59 23 31 12 *", "2024-12-31 23:59:00", "2025-12-31 23:59:00"},
+	}
+	for _, c := range cases {
+		cron, e := ParseCron(c.expr)
+		if e != nil {
+			t.Errorf("%s: %v", c.expr, e)
+			continue
+		}
+		got, ok := cron.Next(at(c.from))
+		if !ok || !got.Equal(at(c.want)) {
+			t.Errorf("%s after %s: %v (%v) instead of %s", c.expr, c.from, got, ok, c.want)
+		}
+	}
+}
+
+func TestCronNever(t *testing.T) {
+	cron, _ := ParseCron("0 0 30 2 *")
+	if got, ok := cron.Next(at("2024-01-01 00:00:00")); ok {
+		t.Errorf("February 30th matched %v", got)
+	}
+}
+
+func TestCronErrors(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *",
+		"* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, e := ParseCron(expr); e == nil {
+			t.Errorf("%s parsed", expr)
+		}
+	}
+}
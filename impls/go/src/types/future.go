@@ -0,0 +1,152 @@
+package types
+
+import (
+	"sync"
+	"time"
+)
+
+// Futures, promises and delays: values that are produced later and
+// can be waited for with deref. A future runs its function on a new
+// goroutine, a promise is delivered by someone else, and a delay runs
+// its function the first time it is forced.
+
+// errors from other goroutines are re-raised as mal exceptions
+func as_mal_error(e error) error {
+	if e == nil {
+		return nil
+	}
+	if _, ok := e.(MalError); ok {
+		return e
+	}
+	return MalError{e.Error()}
+}
+
+// wait for done, at most timeout when it is not negative
+func wait(done chan struct{}, timeout time.Duration) bool {
+	if timeout < 0 {
+		<-done
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func is_closed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+type Future struct {
+	done chan struct{}
+	val  MalType
+	err  error
+	Meta MalType
+}
+
+func NewFuture(f func() (MalType, error)) *Future {
+	fut := &Future{done: make(chan struct{})}
+	Go(func() {
+		fut.val, fut.err = f()
+		close(fut.done)
+	})
+	return fut
+}
+
+func Future_Q(obj MalType) bool {
+	_, ok := obj.(*Future)
+	return ok
+}
+
+// Deref waits for the result, at most timeout unless it is negative,
+// and returns false if it is not there yet
+func (fut *Future) Deref(timeout time.Duration) (MalType, bool, error) {
+	if !wait(fut.done, timeout) {
+		return nil, false, nil
+	}
+	return fut.val, true, as_mal_error(fut.err)
+}
+
+func (fut *Future) Realized() bool {
+	return is_closed(fut.done)
+}
+
+type Promise struct {
+	done chan struct{}
+	once sync.Once
+	val  MalType
+	Meta MalType
+}
+
+func NewPromise() *Promise {
+	return &Promise{done: make(chan struct{})}
+}
+
+func Promise_Q(obj MalType) bool {
+	_, ok := obj.(*Promise)
+	return ok
+}
+
+// Deliver sets the value, and returns false if it was already set
+func (p *Promise) Deliver(val MalType) bool {
+	delivered := false
+	p.once.Do(func() {
+		p.val = val
+		close(p.done)
+		delivered = true
+	})
+	return delivered
+}
+
+func (p *Promise) Deref(timeout time.Duration) (MalType, bool) {
+	if !wait(p.done, timeout) {
+		return nil, false
+	}
+	return p.val, true
+}
+
+func (p *Promise) Realized() bool {
+	return is_closed(p.done)
+}
+
+// Delays remember an error as well as a value: forcing a failed delay
+// raises the same error again
+type Delay struct {
+	mu   sync.Mutex
+	fn   func() (MalType, error)
+	val  MalType
+	err  error
+	Meta MalType
+}
+
+func NewDelay(f func() (MalType, error)) *Delay {
+	return &Delay{fn: f}
+}
+
+func Delay_Q(obj MalType) bool {
+	_, ok := obj.(*Delay)
+	return ok
+}
+
+func (d *Delay) Force() (MalType, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fn != nil {
+		d.val, d.err = d.fn()
+		d.fn = nil
+	}
+	return d.val, d.err
+}
+
+func (d *Delay) Realized() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.fn == nil
+}
@@ -0,0 +1,278 @@
+package types
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// Persistent hash map: a hash array mapped trie (HAMT). Each node
+// consumes 5 bits of the key's Hash and stores its entries densely,
+// indexed through a 32-bit bitmap. Updates copy only the nodes on
+// the path to the changed entry, so the old map stays valid and
+// assoc/dissoc/get touch at most 7 nodes.
+
+const hamt_bits = 5
+const hamt_mask = 1<<hamt_bits - 1
+
+type MapEntry struct {
+	Key MalType
+	Val MalType
+}
+
+// A slot is either a key/value pair or a pointer to a subtree
+type hamt_slot struct {
+	MapEntry
+	node *hamt_node
+}
+
+// Nodes whose keys all share one full hash are collision nodes: the
+// slots are searched linearly and bitmap is unused. Nodes owned by a
+// transient carry its edit token (see transient.go).
+type hamt_node struct {
+	bitmap    uint32
+	slots     []hamt_slot
+	collision bool
+	hash      uint32
+	edit      *edit_token
+}
+
+type HashMap struct {
+	root *hamt_node
+	cnt  int
+	Meta MalType
+}
+
+func NewHashMap(seq MalType) (MalType, error) {
+	lst, e := GetSlice(seq)
+	if e != nil {
+		return nil, e
+	}
+	if len(lst)%2 == 1 {
+		return nil, errors.New("Odd number of arguments to NewHashMap")
+	}
+	hm := HashMap{}
+	for i := 0; i < len(lst); i += 2 {
+		hm = hm.Assoc(lst[i], lst[i+1])
+	}
+	return hm, nil
+}
+
+func HashMap_Q(obj MalType) bool {
+	_, ok := obj.(HashMap)
+	return ok
+}
+
+func (hm HashMap) Count() int {
+	return hm.cnt
+}
+
+func (hm HashMap) Get(key MalType) (MalType, bool) {
+	if hm.root == nil {
+		return nil, false
+	}
+	return hm.root.get(0, Hash(key), key)
+}
+
+func (hm HashMap) Assoc(key MalType, val MalType) HashMap {
+	root := hm.root
+	if root == nil {
+		root = &hamt_node{}
+	}
+	new_root, added := root.assoc(0, Hash(key), key, val)
+	hm.root = new_root
+	if added {
+		hm.cnt += 1
+	}
+	return hm
+}
+
+func (hm HashMap) Dissoc(key MalType) HashMap {
+	if hm.root == nil {
+		return hm
+	}
+	new_root, removed := hm.root.dissoc(0, Hash(key), key)
+	if removed {
+		hm.root = new_root
+		hm.cnt -= 1
+	}
+	return hm
+}
+
+func (hm HashMap) Entries() []MapEntry {
+	entries := make([]MapEntry, 0, hm.cnt)
+	if hm.root != nil {
+		entries = hm.root.entries(entries)
+	}
+	return entries
+}
+
+// position of the hash's 5 bits at this level in the bitmap and in
+// the dense slots slice
+func (n *hamt_node) index(shift uint, hash uint32) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & hamt_mask)
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hamt_node) get(shift uint, hash uint32, key MalType) (MalType, bool) {
+	for {
+		if n.collision {
+			for _, slot := range n.slots {
+				if Equal_Q(slot.Key, key) {
+					return slot.Val, true
+				}
+			}
+			return nil, false
+		}
+		bit, idx := n.index(shift, hash)
+		if n.bitmap&bit == 0 {
+			return nil, false
+		}
+		slot := n.slots[idx]
+		if slot.node == nil {
+			if Equal_Q(slot.Key, key) {
+				return slot.Val, true
+			}
+			return nil, false
+		}
+		n = slot.node
+		shift += hamt_bits
+	}
+}
+
+func (n *hamt_node) assoc(shift uint, hash uint32, key MalType, val MalType) (*hamt_node, bool) {
+	if n.collision {
+		if hash != n.hash {
+			// push the collision node one level down
+			bit := uint32(1) << ((n.hash >> shift) & hamt_mask)
+			parent := &hamt_node{bitmap: bit, slots: []hamt_slot{{node: n}}}
+			return parent.assoc(shift, hash, key, val)
+		}
+		for i, slot := range n.slots {
+			if Equal_Q(slot.Key, key) {
+				ret := n.clone()
+				ret.slots[i].Val = val
+				return ret, false
+			}
+		}
+		ret := n.clone()
+		ret.slots = append(ret.slots, hamt_slot{MapEntry: MapEntry{key, val}})
+		return ret, true
+	}
+	bit, idx := n.index(shift, hash)
+	if n.bitmap&bit == 0 {
+		ret := &hamt_node{bitmap: n.bitmap | bit}
+		ret.slots = make([]hamt_slot, len(n.slots)+1)
+		copy(ret.slots, n.slots[:idx])
+		ret.slots[idx] = hamt_slot{MapEntry: MapEntry{key, val}}
+		copy(ret.slots[idx+1:], n.slots[idx:])
+		return ret, true
+	}
+	slot := n.slots[idx]
+	ret := n.clone()
+	if slot.node != nil {
+		child, added := slot.node.assoc(shift+hamt_bits, hash, key, val)
+		ret.slots[idx].node = child
+		return ret, added
+	}
+	if Equal_Q(slot.Key, key) {
+		ret.slots[idx].Val = val
+		return ret, false
+	}
+	ret.slots[idx] = hamt_slot{node: new_hamt_pair(shift+hamt_bits,
+		Hash(slot.Key), slot.MapEntry, hash, MapEntry{key, val})}
+	return ret, true
+}
+
+// subtree holding two entries whose hashes agree up to shift
+func new_hamt_pair(shift uint, h1 uint32, e1 MapEntry, h2 uint32, e2 MapEntry) *hamt_node {
+	if h1 == h2 {
+		return &hamt_node{slots: []hamt_slot{{MapEntry: e1}, {MapEntry: e2}},
+			collision: true, hash: h1}
+	}
+	b1 := (h1 >> shift) & hamt_mask
+	b2 := (h2 >> shift) & hamt_mask
+	if b1 == b2 {
+		child := new_hamt_pair(shift+hamt_bits, h1, e1, h2, e2)
+		return &hamt_node{bitmap: 1 << b1, slots: []hamt_slot{{node: child}}}
+	}
+	n := &hamt_node{bitmap: 1<<b1 | 1<<b2}
+	if b1 < b2 {
+		n.slots = []hamt_slot{{MapEntry: e1}, {MapEntry: e2}}
+	} else {
+		n.slots = []hamt_slot{{MapEntry: e2}, {MapEntry: e1}}
+	}
+	return n
+}
+
+// Returns a nil node when the last entry was removed
+func (n *hamt_node) dissoc(shift uint, hash uint32, key MalType) (*hamt_node, bool) {
+	if n.collision {
+		for i, slot := range n.slots {
+			if Equal_Q(slot.Key, key) {
+				if len(n.slots) == 1 {
+					return nil, true
+				}
+				return n.without(i, 0), true
+			}
+		}
+		return n, false
+	}
+	bit, idx := n.index(shift, hash)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	slot := n.slots[idx]
+	if slot.node == nil {
+		if !Equal_Q(slot.Key, key) {
+			return n, false
+		}
+		if len(n.slots) == 1 {
+			return nil, true
+		}
+		return n.without(idx, bit), true
+	}
+	child, removed := slot.node.dissoc(shift+hamt_bits, hash, key)
+	if !removed {
+		return n, false
+	}
+	if child == nil {
+		if len(n.slots) == 1 {
+			return nil, true
+		}
+		return n.without(idx, bit), true
+	}
+	ret := n.clone()
+	if len(child.slots) == 1 && child.slots[0].node == nil {
+		// pull a lone entry up into this node
+		ret.slots[idx] = child.slots[0]
+	} else {
+		ret.slots[idx].node = child
+	}
+	return ret, true
+}
+
+func (n *hamt_node) clone() *hamt_node {
+	ret := *n
+	ret.slots = append([]hamt_slot{}, n.slots...)
+	return &ret
+}
+
+func (n *hamt_node) without(idx int, bit uint32) *hamt_node {
+	ret := *n
+	ret.bitmap = n.bitmap &^ bit
+	ret.slots = make([]hamt_slot, 0, len(n.slots)-1)
+	ret.slots = append(ret.slots, n.slots[:idx]...)
+	ret.slots = append(ret.slots, n.slots[idx+1:]...)
+	return &ret
+}
+
+func (n *hamt_node) entries(acc []MapEntry) []MapEntry {
+	for _, slot := range n.slots {
+		if slot.node != nil {
+			acc = slot.node.entries(acc)
+		} else {
+			acc = append(acc, slot.MapEntry)
+		}
+	}
+	return acc
+}
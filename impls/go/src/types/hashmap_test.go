@@ -0,0 +1,171 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+)
+
+// copying_map is the previous HashMap representation: Go map buckets
+// keyed by Hash, copied in full on every update
+type copying_map map[uint32][]MapEntry
+
+func (m copying_map) assoc(key MalType, val MalType) copying_map {
+	new_m := copying_map{}
+	for h, bucket := range m {
+		new_m[h] = append([]MapEntry{}, bucket...)
+	}
+	h := Hash(key)
+	for i, ent := range new_m[h] {
+		if Equal_Q(ent.Key, key) {
+			new_m[h][i].Val = val
+			return new_m
+		}
+	}
+	new_m[h] = append(new_m[h], MapEntry{key, val})
+	return new_m
+}
+
+func (m copying_map) get(key MalType) (MalType, bool) {
+	for _, ent := range m[Hash(key)] {
+		if Equal_Q(ent.Key, key) {
+			return ent.Val, true
+		}
+	}
+	return nil, false
+}
+
+func TestHashMapPersistence(t *testing.T) {
+	const n = 5000
+	versions := make([]HashMap, 0, n+1)
+	hm := HashMap{}
+	for i := 0; i < n; i++ {
+		versions = append(versions, hm)
+		hm = hm.Assoc(i, i*i)
+	}
+	versions = append(versions, hm)
+	for size, v := range versions {
+		if v.Count() != size {
+			t.Fatalf("version %d has count %d", size, v.Count())
+		}
+		if size%500 != 0 {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			val, ok := v.Get(i)
+			if ok != (i < size) || (ok && val != i*i) {
+				t.Fatalf("version %d: Get(%d) = %v, %v", size, i, val, ok)
+			}
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		hm = hm.Dissoc(i)
+	}
+	if hm.Count() != n/2 || len(hm.Entries()) != n/2 {
+		t.Fatalf("count after dissoc: %d", hm.Count())
+	}
+	for i := 0; i < n; i++ {
+		if _, ok := hm.Get(i); ok != (i%2 == 1) {
+			t.Fatalf("Get(%d) after dissoc", i)
+		}
+		if _, ok := versions[n].Get(i); !ok {
+			t.Fatalf("dissoc changed the original map at %d", i)
+		}
+	}
+}
+
+func TestHashMapCollisions(t *testing.T) {
+	// lists and vectors with equal elements are equal keys
+	hm := HashMap{}.Assoc(NewList(1, 2), "a").Assoc(NewVector(1, 2), "b")
+	if hm.Count() != 1 {
+		t.Fatalf("expected one key, got %d", hm.Count())
+	}
+	// strings whose full hashes collide end up in collision nodes
+	seen := map[uint32]string{}
+	keys := []MalType{}
+	for i := 0; len(keys) < 20; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if other, ok := seen[Hash(k)]; ok {
+			keys = append(keys, other, k)
+		}
+		seen[Hash(k)] = k
+	}
+	hm = HashMap{}
+	for _, k := range keys {
+		hm = hm.Assoc(k, k)
+	}
+	if hm.Count() != len(keys) {
+		t.Fatalf("collision count %d", hm.Count())
+	}
+	for _, k := range keys {
+		if v, ok := hm.Get(k); !ok || v != k {
+			t.Fatalf("collision get %v", k)
+		}
+	}
+	for i, k := range keys {
+		hm = hm.Dissoc(k)
+		for _, k2 := range keys[i+1:] {
+			if _, ok := hm.Get(k2); !ok {
+				t.Fatalf("lost %v after removing %v", k2, k)
+			}
+		}
+	}
+	if hm.Count() != 0 {
+		t.Fatalf("count after removing collisions %d", hm.Count())
+	}
+}
+
+var sizes = []int{10, 100, 1000}
+
+func BenchmarkBuildCopying(b *testing.B) {
+	for _, n := range sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := copying_map{}
+				for k := 0; k < n; k++ {
+					m = m.assoc(k, k)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBuildHAMT(b *testing.B) {
+	for _, n := range sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hm := HashMap{}
+				for k := 0; k < n; k++ {
+					hm = hm.Assoc(k, k)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetCopying(b *testing.B) {
+	for _, n := range sizes {
+		m := copying_map{}
+		for k := 0; k < n; k++ {
+			m = m.assoc(k, k)
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.get(i % n)
+			}
+		})
+	}
+}
+
+func BenchmarkGetHAMT(b *testing.B) {
+	for _, n := range sizes {
+		hm := HashMap{}
+		for k := 0; k < n; k++ {
+			hm = hm.Assoc(k, k)
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hm.Get(i % n)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"sync"
+)
+
+// Symbol names are interned to small integer ids, so that code
+// resolving symbols can compare ids instead of strings
+var symbol_ids = map[string]int{}
+var symbol_names = []string{}
+var symbol_mu sync.RWMutex
+
+func Intern(name string) int {
+	symbol_mu.RLock()
+	id, ok := symbol_ids[name]
+	symbol_mu.RUnlock()
+	if ok {
+		return id
+	}
+	symbol_mu.Lock()
+	defer symbol_mu.Unlock()
+	if id, ok := symbol_ids[name]; ok {
+		return id
+	}
+	id = len(symbol_names)
+	symbol_ids[name] = id
+	symbol_names = append(symbol_names, name)
+	return id
+}
+
+func InternedName(id int) string {
+	symbol_mu.RLock()
+	defer symbol_mu.RUnlock()
+	return symbol_names[id]
+}
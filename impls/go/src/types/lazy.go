@@ -0,0 +1,161 @@
+package types
+
+import (
+	"errors"
+	"sync"
+)
+
+// Lazy sequences: a cell holds a function producing the sequence.
+// The first time the cell is looked at the function is called once,
+// and its result is split into a first element and the rest, which
+// may itself be lazy. The function runs without the lock held; other
+// goroutines looking at the cell meanwhile wait for its result. As
+// with sync.Once, a function that looks at its own cell never returns.
+type lazy_cell struct {
+	mu      sync.Mutex
+	fn      func() (MalType, error)
+	running bool
+	waiting *sync.Cond // made by the first goroutine that waits
+	empty   bool
+	first   MalType
+	rest    MalType
+	err     error
+}
+
+type LazySeq struct {
+	cell *lazy_cell
+	Meta MalType
+}
+
+func NewLazySeq(fn func() (MalType, error)) LazySeq {
+	return LazySeq{&lazy_cell{fn: fn}, nil}
+}
+
+// NewCons prepends first to rest without realizing rest
+func NewCons(first MalType, rest MalType) LazySeq {
+	return LazySeq{&lazy_cell{first: first, rest: rest}, nil}
+}
+
+func LazySeq_Q(obj MalType) bool {
+	_, ok := obj.(LazySeq)
+	return ok
+}
+
+func (ls LazySeq) realize() (*lazy_cell, error) {
+	c := ls.cell
+	c.mu.Lock()
+	for c.running {
+		if c.waiting == nil {
+			c.waiting = sync.NewCond(&c.mu)
+		}
+		c.waiting.Wait()
+	}
+	if c.fn == nil {
+		c.mu.Unlock()
+		return c, c.err
+	}
+	fn := c.fn
+	c.fn = nil
+	c.running = true
+	c.mu.Unlock()
+
+	var first, rest MalType
+	var ok bool
+	res, e := fn()
+	if e == nil {
+		first, rest, ok, e = Uncons(res)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.first, c.rest, c.empty, c.err = first, rest, !ok, e
+	c.running = false
+	if c.waiting != nil {
+		c.waiting.Broadcast()
+	}
+	return c, e
+}
+
+// Realized is true once the function of the first cell has run
+func (ls LazySeq) Realized() bool {
+	ls.cell.mu.Lock()
+	defer ls.cell.mu.Unlock()
+	return ls.cell.fn == nil && !ls.cell.running
+}
+
+func (ls LazySeq) First() (MalType, error) {
+	c, e := ls.realize()
+	if e != nil {
+		return nil, e
+	}
+	return c.first, nil
+}
+
+// Rest is the (possibly lazy) remainder, an empty list at the end
+func (ls LazySeq) Rest() (MalType, error) {
+	c, e := ls.realize()
+	if e != nil {
+		return nil, e
+	}
+	if c.empty {
+		return List{}, nil
+	}
+	return c.rest, nil
+}
+
+func (ls LazySeq) Empty() (bool, error) {
+	c, e := ls.realize()
+	if e != nil {
+		return false, e
+	}
+	return c.empty, nil
+}
+
+// Uncons splits a sequence into its first element and the rest; ok
+// is false when the sequence is empty
+func Uncons(seq MalType) (first MalType, rest MalType, ok bool, err error) {
+	switch obj := seq.(type) {
+	case nil:
+		return nil, nil, false, nil
+	case LazySeq:
+		c, e := obj.realize()
+		if e != nil {
+			return nil, nil, false, e
+		}
+		return c.first, c.rest, !c.empty, nil
+	case List:
+		if len(obj.Val) == 0 {
+			return nil, nil, false, nil
+		}
+		return obj.Val[0], List{obj.Val[1:], nil}, true, nil
+	default:
+		slc, e := GetSlice(seq)
+		if e != nil {
+			return nil, nil, false, errors.New("can't create a seq from this type")
+		}
+		if len(slc) == 0 {
+			return nil, nil, false, nil
+		}
+		return slc[0], List{slc[1:], nil}, true, nil
+	}
+}
+
+// lazy_slice realizes the whole sequence
+func lazy_slice(ls LazySeq) ([]MalType, error) {
+	slc := []MalType{}
+	var seq MalType = ls
+	for {
+		if l, ok := seq.(List); ok {
+			return append(slc, l.Val...), nil
+		}
+		first, rest, ok, e := Uncons(seq)
+		if e != nil {
+			return nil, e
+		}
+		if !ok {
+			return slc, nil
+		}
+		slc = append(slc, first)
+		seq = rest
+	}
+}
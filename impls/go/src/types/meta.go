@@ -0,0 +1,153 @@
+package types
+
+import (
+	"errors"
+	"sync"
+)
+
+// Metadata: values (symbols, collections, functions) get new
+// metadata by copying with WithMeta. Reference types (atoms, refs,
+// agents, futures, promises, delays, channels, processes,
+// multimethods, protocols) keep their identity, so their metadata is
+// changed in place with AlterMeta instead.
+
+// guards the metadata of reference types; the generation is bumped
+// on every change
+var ref_meta_mu sync.Mutex
+var ref_meta_gen uint64
+
+func WithMeta(obj MalType, m MalType) (MalType, error) {
+	switch tobj := obj.(type) {
+	case Symbol:
+		tobj.Meta = m
+		return tobj, nil
+	case List:
+		return List{tobj.Val, m}, nil
+	case Vector:
+		tobj.Meta = m
+		return tobj, nil
+	case HashMap:
+		tobj.Meta = m
+		return tobj, nil
+	case ArrayMap:
+		tobj.Meta = m
+		return tobj, nil
+	case Record:
+		tobj.Meta = m
+		return tobj, nil
+	case Set:
+		tobj.Meta = m
+		return tobj, nil
+	case SortedMap:
+		tobj.Meta = m
+		return tobj, nil
+	case SortedSet:
+		tobj.Meta = m
+		return tobj, nil
+	case LazySeq:
+		tobj.Meta = m
+		return tobj, nil
+	case Func:
+		return Func{tobj.Fn, m}, nil
+	case MalFunc:
+		fn := tobj
+		fn.Meta = m
+		return fn, nil
+	case *Atom, *Ref, *Agent, *Future, *Promise, *Delay, *Chan, *Process, *Timer, *MultiFn, *Protocol:
+		return nil, errors.New("with-meta not supported on " + TypeName(obj) +
+			", use alter-meta! or reset-meta!")
+	default:
+		return nil, errors.New("with-meta not supported on " + TypeName(obj))
+	}
+}
+
+func GetMeta(obj MalType) (MalType, error) {
+	switch tobj := obj.(type) {
+	case Symbol:
+		return tobj.Meta, nil
+	case List:
+		return tobj.Meta, nil
+	case Vector:
+		return tobj.Meta, nil
+	case HashMap:
+		return tobj.Meta, nil
+	case ArrayMap:
+		return tobj.Meta, nil
+	case Record:
+		return tobj.Meta, nil
+	case Set:
+		return tobj.Meta, nil
+	case SortedMap:
+		return tobj.Meta, nil
+	case SortedSet:
+		return tobj.Meta, nil
+	case LazySeq:
+		return tobj.Meta, nil
+	case Func:
+		return tobj.Meta, nil
+	case MalFunc:
+		return tobj.Meta, nil
+	case *Atom, *Ref, *Agent, *Future, *Promise, *Delay, *Chan, *Process, *Timer, *MultiFn, *Protocol:
+		ref_meta_mu.Lock()
+		defer ref_meta_mu.Unlock()
+		return *ref_meta(obj), nil
+	default:
+		return nil, errors.New("meta not supported on " + TypeName(obj))
+	}
+}
+
+func ref_meta(obj MalType) *MalType {
+	switch tobj := obj.(type) {
+	case *Atom:
+		return &tobj.Meta
+	case *Ref:
+		return &tobj.Meta
+	case *Agent:
+		return &tobj.Meta
+	case *Future:
+		return &tobj.Meta
+	case *Promise:
+		return &tobj.Meta
+	case *Delay:
+		return &tobj.Meta
+	case *Chan:
+		return &tobj.Meta
+	case *Process:
+		return &tobj.Meta
+	case *Timer:
+		return &tobj.Meta
+	case *MultiFn:
+		return &tobj.Meta
+	case *Protocol:
+		return &tobj.Meta
+	}
+	return nil
+}
+
+// AlterMeta replaces the metadata of a reference with f applied to
+// the old metadata, and returns the new metadata. f runs without the
+// lock held (it may look at metadata itself) and is retried if
+// another change got in first.
+func AlterMeta(obj MalType, f func(MalType) (MalType, error)) (MalType, error) {
+	pm := ref_meta(obj)
+	if pm == nil {
+		return nil, errors.New("alter-meta! not supported on " + TypeName(obj))
+	}
+	for {
+		ref_meta_mu.Lock()
+		old, gen := *pm, ref_meta_gen
+		ref_meta_mu.Unlock()
+		m, e := f(old)
+		if e != nil {
+			return nil, e
+		}
+		ref_meta_mu.Lock()
+		if gen == ref_meta_gen {
+			*pm = m
+			ref_meta_gen += 1
+			ref_meta_mu.Unlock()
+			return m, nil
+		}
+		ref_meta_mu.Unlock()
+	}
+}
@@ -0,0 +1,195 @@
+package types
+
+import (
+	"errors"
+	"sync"
+)
+
+// Hierarchy: a global relation between keywords (or symbols) built
+// with Derive and queried with Isa. Every change bumps the version so
+// that multimethods know to drop their dispatch caches.
+var hierarchy struct {
+	mu      sync.RWMutex
+	parents HashMap // child -> Set of parents
+	version uint64
+}
+
+func hierarchy_key_Q(obj MalType) bool {
+	return Keyword_Q(obj) || Symbol_Q(obj)
+}
+
+func Derive(child MalType, parent MalType) error {
+	if !hierarchy_key_Q(child) || !hierarchy_key_Q(parent) {
+		return errors.New("derive: child and parent must be keywords or symbols")
+	}
+	if Equal_Q(child, parent) || Isa(parent, child) {
+		return errors.New("derive: cyclic derivation")
+	}
+	hierarchy.mu.Lock()
+	defer hierarchy.mu.Unlock()
+	ps, _ := hierarchy.parents.Get(child)
+	set, _ := ps.(Set)
+	hierarchy.parents = hierarchy.parents.Assoc(child, set.Conj(parent))
+	hierarchy.version += 1
+	return nil
+}
+
+func Underive(child MalType, parent MalType) {
+	hierarchy.mu.Lock()
+	defer hierarchy.mu.Unlock()
+	ps, ok := hierarchy.parents.Get(child)
+	if !ok {
+		return
+	}
+	set := ps.(Set).Disj(parent)
+	if set.Count() == 0 {
+		hierarchy.parents = hierarchy.parents.Dissoc(child)
+	} else {
+		hierarchy.parents = hierarchy.parents.Assoc(child, set)
+	}
+	hierarchy.version += 1
+}
+
+func Parents(child MalType) Set {
+	hierarchy.mu.RLock()
+	defer hierarchy.mu.RUnlock()
+	ps, _ := hierarchy.parents.Get(child)
+	set, _ := ps.(Set)
+	return set
+}
+
+func Ancestors(child MalType) Set {
+	res := Set{}
+	todo := Parents(child).Elements()
+	for len(todo) > 0 {
+		p := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if !res.Contains(p) {
+			res = res.Conj(p)
+			todo = append(todo, Parents(p).Elements()...)
+		}
+	}
+	return res
+}
+
+// Isa is true when child equals parent, derives from it, or both are
+// vectors of the same length whose elements are pairwise Isa
+func Isa(child MalType, parent MalType) bool {
+	if Equal_Q(child, parent) {
+		return true
+	}
+	cv, ok1 := child.(Vector)
+	pv, ok2 := parent.(Vector)
+	if ok1 && ok2 {
+		if cv.Count() != pv.Count() {
+			return false
+		}
+		for i := 0; i < cv.Count(); i++ {
+			c, _ := cv.Nth(i)
+			p, _ := pv.Nth(i)
+			if !Isa(c, p) {
+				return false
+			}
+		}
+		return true
+	}
+	return hierarchy_key_Q(child) && Ancestors(child).Contains(parent)
+}
+
+// Multimethods: Dispatch computes a dispatch value from the
+// arguments, which selects a method by Isa, falling back to the
+// method for DefaultVal. Fn performs the call and is installed by the
+// creator so that errors can print the dispatch value.
+type MultiFn struct {
+	Name       string
+	Dispatch   MalType
+	DefaultVal MalType
+	Fn         func([]MalType) (MalType, error)
+	mu         sync.RWMutex
+	methods    HashMap
+	gen        uint64 // bumped when methods change
+	cache      HashMap
+	cache_ver  uint64 // hierarchy version the cache was built for
+	Meta       MalType
+}
+
+func MultiFn_Q(obj MalType) bool {
+	_, ok := obj.(*MultiFn)
+	return ok
+}
+
+func (mf *MultiFn) AddMethod(dv MalType, f MalType) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.methods = mf.methods.Assoc(dv, f)
+	mf.gen += 1
+	mf.cache = HashMap{}
+}
+
+func (mf *MultiFn) RemoveMethod(dv MalType) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.methods = mf.methods.Dissoc(dv)
+	mf.gen += 1
+	mf.cache = HashMap{}
+}
+
+func (mf *MultiFn) Methods() HashMap {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	return mf.methods
+}
+
+// FindMethod returns the method for dispatch value dv, or nil. When
+// several methods match and none of them is more specific than all the
+// others, it returns their dispatch values instead.
+func (mf *MultiFn) FindMethod(dv MalType) (MalType, []MalType) {
+	hierarchy.mu.RLock()
+	version := hierarchy.version
+	hierarchy.mu.RUnlock()
+	mf.mu.RLock()
+	if mf.cache_ver == version {
+		if f, ok := mf.cache.Get(dv); ok {
+			mf.mu.RUnlock()
+			return f, nil
+		}
+	}
+	methods, gen := mf.methods, mf.gen
+	mf.mu.RUnlock()
+
+	f, ok := methods.Get(dv)
+	if !ok {
+		var best MalType
+		matches := []MalType{}
+		for _, ent := range methods.Entries() {
+			if Isa(dv, ent.Key) {
+				if len(matches) == 0 || Isa(ent.Key, best) {
+					best = ent.Key
+				}
+				matches = append(matches, ent.Key)
+			}
+		}
+		for _, m := range matches {
+			if !Isa(best, m) {
+				return nil, matches
+			}
+		}
+		if len(matches) > 0 {
+			f, _ = methods.Get(best)
+		} else {
+			f, _ = methods.Get(mf.DefaultVal)
+		}
+	}
+	if f != nil {
+		mf.mu.Lock()
+		if mf.gen == gen {
+			if mf.cache_ver != version {
+				mf.cache = HashMap{}
+				mf.cache_ver = version
+			}
+			mf.cache = mf.cache.Assoc(dv, f)
+		}
+		mf.mu.Unlock()
+	}
+	return f, nil
+}
@@ -0,0 +1,99 @@
+package types
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// helpers bounds the goroutines helping ParallelMap calls, however
+// they nest, to GOMAXPROCS
+var helpers = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// ParallelMap computes f(0) ... f(n-1) and returns the results in
+// order. The calling goroutine takes part, helped by as many goroutines
+// as are free, so nested calls never wait for each other. After the
+// first error no new calls are started (calls already running finish)
+// and that error is returned.
+func ParallelMap(n int, f func(int) (MalType, error)) ([]MalType, error) {
+	results := make([]MalType, n)
+	var next atomic.Int64
+	var failed atomic.Bool
+	var first_err error
+	var once sync.Once
+	var wg sync.WaitGroup
+	work := func() {
+		for !failed.Load() {
+			i := int(next.Add(1) - 1)
+			if i >= n {
+				return
+			}
+			res, e := f(i)
+			if e != nil {
+				once.Do(func() {
+					first_err = e
+					failed.Store(true)
+				})
+				return
+			}
+			results[i] = res
+		}
+	}
+helping:
+	for w := 1; w < n; w++ {
+		select {
+		case helpers <- struct{}{}:
+			wg.Add(1)
+			Go(func() {
+				defer wg.Done()
+				defer func() { <-helpers }()
+				work()
+			})
+		default:
+			break helping
+		}
+	}
+	work()
+	wg.Wait()
+	if first_err != nil {
+		return nil, first_err
+	}
+	return results, nil
+}
+
+// ParallelReduce reduces elems with the associative function f: the
+// elements are split in chunks reduced in parallel, then neighbouring
+// results are combined in parallel, pairwise, until one is left.
+// elems must not be empty.
+func ParallelReduce(f MalType, elems []MalType) (MalType, error) {
+	chunks := runtime.GOMAXPROCS(0) * 4
+	size := (len(elems) + chunks - 1) / chunks
+	chunks = (len(elems) + size - 1) / size
+	partials, e := ParallelMap(chunks, func(c int) (MalType, error) {
+		chunk := elems[c*size:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		acc := chunk[0]
+		for _, x := range chunk[1:] {
+			var e error
+			if acc, e = Apply(f, []MalType{acc, x}); e != nil {
+				return nil, e
+			}
+		}
+		return acc, nil
+	})
+	for e == nil && len(partials) > 1 {
+		level := partials
+		partials, e = ParallelMap((len(level)+1)/2, func(i int) (MalType, error) {
+			if 2*i+1 == len(level) {
+				return level[2*i], nil
+			}
+			return Apply(f, []MalType{level[2*i], level[2*i+1]})
+		})
+	}
+	if e != nil {
+		return nil, e
+	}
+	return partials[0], nil
+}
@@ -0,0 +1,152 @@
+package types
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Protocols: named sets of methods dispatching on the type of their
+// first argument. A protocol is extended to a type name; a value is
+// matched against its own type name (see TypeName), then its Go type
+// name (string, int, ...), then the type it stands in for (List for
+// lazy sequences), then its family (Sequential, Map, Set), then
+// Object. The method table resolved for each type is cached until
+// the protocol is next extended; record types are told apart from
+// built-in types of the same name.
+type Protocol struct {
+	Name    string
+	Methods []string
+	mu      sync.RWMutex
+	impls   map[string]map[string]MalType
+	cache   map[MalType]map[string]MalType // by dispatch_key
+	Meta    MalType
+}
+
+func NewProtocol(name string, methods []string) *Protocol {
+	return &Protocol{Name: name, Methods: methods,
+		impls: map[string]map[string]MalType{},
+		cache: map[MalType]map[string]MalType{}}
+}
+
+func Protocol_Q(obj MalType) bool {
+	_, ok := obj.(*Protocol)
+	return ok
+}
+
+func (p *Protocol) HasMethod(method string) bool {
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Extend adds (or replaces) the implementations of methods for the
+// type named type_name
+func (p *Protocol) Extend(type_name string, fns map[string]MalType) error {
+	for m := range fns {
+		if !p.HasMethod(m) {
+			return fmt.Errorf("%s is not a method of protocol %s", m, p.Name)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	impl := map[string]MalType{}
+	for m, f := range p.impls[type_name] {
+		impl[m] = f
+	}
+	for m, f := range fns {
+		impl[m] = f
+	}
+	p.impls[type_name] = impl
+	p.cache = map[MalType]map[string]MalType{}
+	return nil
+}
+
+func (p *Protocol) resolve(obj MalType) map[string]MalType {
+	key := dispatch_key(obj)
+	p.mu.RLock()
+	table, ok := p.cache[key]
+	p.mu.RUnlock()
+	if ok {
+		return table
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	table = map[string]MalType{}
+	names := dispatch_names(obj)
+	// more specific names are applied last and win
+	for i := len(names) - 1; i >= 0; i-- {
+		for m, f := range p.impls[names[i]] {
+			table[m] = f
+		}
+	}
+	p.cache[key] = table
+	return table
+}
+
+func (p *Protocol) Lookup(obj MalType, method string) (MalType, bool) {
+	f, ok := p.resolve(obj)[method]
+	return f, ok
+}
+
+// Satisfies is true when the protocol is extended to the type of obj
+func (p *Protocol) Satisfies(obj MalType) bool {
+	return len(p.resolve(obj)) > 0
+}
+
+// Method returns the function dispatching method on its first argument
+func (p *Protocol) Method(method string) Func {
+	return Func{func(a []MalType) (MalType, error) {
+		if len(a) < 1 {
+			return nil, fmt.Errorf("%s requires at least 1 argument", method)
+		}
+		f, ok := p.Lookup(a[0], method)
+		if !ok {
+			return nil, fmt.Errorf("no implementation of method %s of protocol %s for type %s",
+				method, p.Name, TypeName(a[0]))
+		}
+		return Apply(f, a)
+	}, nil}
+}
+
+// dispatch_key identifies the type of obj: its record type, or its
+// type name
+func dispatch_key(obj MalType) MalType {
+	if r, ok := obj.(Record); ok {
+		return r.Type
+	}
+	return TypeName(obj)
+}
+
+func dispatch_names(obj MalType) []string {
+	names := []string{TypeName(obj)}
+	if obj == nil {
+		return names
+	}
+	if _, ok := obj.(ArrayMap); ok {
+		// named HashMap by TypeName
+		return append(names, "Map", "Object")
+	}
+	if go_name := _obj_type(obj); go_name != "" && go_name != names[0] {
+		names = append(names, go_name)
+	}
+	switch tobj := obj.(type) {
+	case SortedSet:
+		names = append(names, "Set")
+	case LazySeq:
+		names = append(names, "List", "Sequential")
+	case Record:
+		if tobj.Type.IsMap {
+			names = append(names, "Map")
+		}
+	default:
+		if Sequential_Q(obj) {
+			names = append(names, "Sequential")
+		} else if Map_Q(obj) {
+			names = append(names, "Map")
+		}
+	}
+	return append(names, "Object")
+}
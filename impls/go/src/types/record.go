@@ -0,0 +1,116 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Record types are registered by name. Redefining a name registers a
+// new type; records built by the old constructors keep the old type.
+type RecordType struct {
+	Name   string
+	Fields []MalType // keywords
+	IsMap  bool      // defrecord rather than deftype
+	index  map[string]int
+}
+
+var record_types = map[string]*RecordType{}
+var record_types_mu sync.RWMutex
+
+func DefRecordType(name string, fields []MalType, is_map bool) (*RecordType, error) {
+	rt := &RecordType{name, fields, is_map, map[string]int{}}
+	for i, f := range fields {
+		k, ok := f.(string)
+		if !ok || !Keyword_Q(k) {
+			return nil, errors.New("record fields must be keywords")
+		}
+		rt.index[k] = i
+	}
+	record_types_mu.Lock()
+	record_types[name] = rt
+	record_types_mu.Unlock()
+	return rt, nil
+}
+
+func LookupRecordType(name string) (*RecordType, bool) {
+	record_types_mu.RLock()
+	defer record_types_mu.RUnlock()
+	rt, ok := record_types[name]
+	return rt, ok
+}
+
+// Records hold their field values in declaration order. Keys other
+// than the fields (defrecord only) are kept in ext, in insertion order.
+type Record struct {
+	Type *RecordType
+	vals []MalType
+	ext  ArrayMap
+	Meta MalType
+}
+
+func NewRecord(rt *RecordType, vals []MalType) (Record, error) {
+	if len(vals) != len(rt.Fields) {
+		return Record{}, fmt.Errorf("wrong number of fields for %s (%d instead of %d)",
+			rt.Name, len(vals), len(rt.Fields))
+	}
+	return Record{rt, append([]MalType{}, vals...), ArrayMap{}, nil}, nil
+}
+
+func Record_Q(obj MalType) bool {
+	_, ok := obj.(Record)
+	return ok
+}
+
+func (r Record) Count() int {
+	return len(r.vals) + r.ext.Count()
+}
+
+func (r Record) Get(key MalType) (MalType, bool) {
+	if k, ok := key.(string); ok {
+		if i, ok := r.Type.index[k]; ok {
+			return r.vals[i], true
+		}
+	}
+	return r.ext.Get(key)
+}
+
+func (r Record) Assoc(key MalType, val MalType) Record {
+	if k, ok := key.(string); ok {
+		if i, ok := r.Type.index[k]; ok {
+			vals := append([]MalType{}, r.vals...)
+			vals[i] = val
+			r.vals = vals
+			return r
+		}
+	}
+	r.ext = r.ext.Assoc(key, val)
+	return r
+}
+
+// Dissoc of a field leaves a plain map, since the result no longer
+// has the fields of its type
+func (r Record) Dissoc(key MalType) MalType {
+	if k, ok := key.(string); ok {
+		if _, ok := r.Type.index[k]; ok {
+			am := ArrayMap{Meta: r.Meta}
+			for _, ent := range r.Entries() {
+				if ent.Key != key {
+					am = am.Assoc(ent.Key, ent.Val)
+				}
+			}
+			return am
+		}
+	}
+	r.ext = r.ext.Dissoc(key)
+	return r
+}
+
+// Entries returns the fields in declaration order, then any other keys
+func (r Record) Entries() []MapEntry {
+	entries := make([]MapEntry, 0, r.Count())
+	for i, f := range r.Type.Fields {
+		entries = append(entries, MapEntry{f, r.vals[i]})
+	}
+	return append(entries, r.ext.Entries()...)
+}
@@ -0,0 +1,55 @@
+package types
+
+// Sets are hash maps from each element to itself
+type Set struct {
+	hm   HashMap
+	Meta MalType
+}
+
+func NewSet(a ...MalType) Set {
+	s := Set{}
+	for _, x := range a {
+		s = s.Conj(x)
+	}
+	return s
+}
+
+func Set_Q(obj MalType) bool {
+	_, ok := obj.(Set)
+	return ok
+}
+
+func (s Set) Count() int {
+	return s.hm.Count()
+}
+
+func (s Set) Contains(x MalType) bool {
+	_, ok := s.hm.Get(x)
+	return ok
+}
+
+// Get returns the element of the set equal to x
+func (s Set) Get(x MalType) (MalType, bool) {
+	return s.hm.Get(x)
+}
+
+func (s Set) Conj(x MalType) Set {
+	if !s.Contains(x) {
+		s.hm = s.hm.Assoc(x, x)
+	}
+	return s
+}
+
+func (s Set) Disj(x MalType) Set {
+	s.hm = s.hm.Dissoc(x)
+	return s
+}
+
+func (s Set) Elements() []MalType {
+	entries := s.hm.Entries()
+	elems := make([]MalType, 0, len(entries))
+	for _, ent := range entries {
+		elems = append(elems, ent.Key)
+	}
+	return elems
+}
@@ -0,0 +1,288 @@
+package types
+
+// Persistent AVL tree ordered by a comparator (see CompareWith).
+// Updates copy the path from the root to the changed node and
+// rebalance on the way back up, so the old tree stays valid.
+type tree_node struct {
+	MapEntry
+	left   *tree_node
+	right  *tree_node
+	height int
+}
+
+func (n *tree_node) get_height() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func new_tree_node(ent MapEntry, left *tree_node, right *tree_node) *tree_node {
+	h := left.get_height()
+	if right.get_height() > h {
+		h = right.get_height()
+	}
+	return &tree_node{ent, left, right, h + 1}
+}
+
+func rotate_left(n *tree_node) *tree_node {
+	r := n.right
+	return new_tree_node(r.MapEntry, new_tree_node(n.MapEntry, n.left, r.left), r.right)
+}
+
+func rotate_right(n *tree_node) *tree_node {
+	l := n.left
+	return new_tree_node(l.MapEntry, l.left, new_tree_node(n.MapEntry, l.right, n.right))
+}
+
+func balance(ent MapEntry, left *tree_node, right *tree_node) *tree_node {
+	n := new_tree_node(ent, left, right)
+	switch diff := left.get_height() - right.get_height(); {
+	case diff > 1:
+		if left.left.get_height() < left.right.get_height() {
+			n.left = rotate_left(left)
+		}
+		return rotate_right(n)
+	case diff < -1:
+		if right.right.get_height() < right.left.get_height() {
+			n.right = rotate_right(right)
+		}
+		return rotate_left(n)
+	}
+	return n
+}
+
+func tree_insert(cmp MalType, n *tree_node, key MalType, val MalType) (*tree_node, bool, error) {
+	if n == nil {
+		return new_tree_node(MapEntry{key, val}, nil, nil), true, nil
+	}
+	c, e := CompareWith(cmp, key, n.Key)
+	if e != nil {
+		return nil, false, e
+	}
+	switch {
+	case c < 0:
+		left, added, e := tree_insert(cmp, n.left, key, val)
+		if e != nil {
+			return nil, false, e
+		}
+		return balance(n.MapEntry, left, n.right), added, nil
+	case c > 0:
+		right, added, e := tree_insert(cmp, n.right, key, val)
+		if e != nil {
+			return nil, false, e
+		}
+		return balance(n.MapEntry, n.left, right), added, nil
+	default:
+		return &tree_node{MapEntry{n.Key, val}, n.left, n.right, n.height}, false, nil
+	}
+}
+
+func tree_remove_min(n *tree_node) (*tree_node, MapEntry) {
+	if n.left == nil {
+		return n.right, n.MapEntry
+	}
+	left, min := tree_remove_min(n.left)
+	return balance(n.MapEntry, left, n.right), min
+}
+
+func tree_delete(cmp MalType, n *tree_node, key MalType) (*tree_node, bool, error) {
+	if n == nil {
+		return nil, false, nil
+	}
+	c, e := CompareWith(cmp, key, n.Key)
+	if e != nil {
+		return nil, false, e
+	}
+	switch {
+	case c < 0:
+		left, removed, e := tree_delete(cmp, n.left, key)
+		if e != nil || !removed {
+			return n, false, e
+		}
+		return balance(n.MapEntry, left, n.right), true, nil
+	case c > 0:
+		right, removed, e := tree_delete(cmp, n.right, key)
+		if e != nil || !removed {
+			return n, false, e
+		}
+		return balance(n.MapEntry, n.left, right), true, nil
+	default:
+		if n.left == nil {
+			return n.right, true, nil
+		} else if n.right == nil {
+			return n.left, true, nil
+		}
+		right, min := tree_remove_min(n.right)
+		return balance(min, n.left, right), true, nil
+	}
+}
+
+// tree_walk visits the entries in order, ascending or descending,
+// starting at from when has_from is set, until f returns false
+func tree_walk(cmp MalType, n *tree_node, from MalType, has_from bool, ascending bool,
+	f func(MapEntry) bool) (bool, error) {
+	if n == nil {
+		return true, nil
+	}
+	near, far := n.left, n.right
+	if !ascending {
+		near, far = far, near
+	}
+	if has_from {
+		c, e := CompareWith(cmp, n.Key, from)
+		if e != nil {
+			return false, e
+		}
+		if (ascending && c < 0) || (!ascending && c > 0) {
+			// this node and the near subtree come before from
+			return tree_walk(cmp, far, from, has_from, ascending, f)
+		}
+	}
+	if cont, e := tree_walk(cmp, near, from, has_from, ascending, f); !cont || e != nil {
+		return false, e
+	}
+	if !f(n.MapEntry) {
+		return false, nil
+	}
+	return tree_walk(cmp, far, nil, false, ascending, f)
+}
+
+// Sorted maps
+type SortedMap struct {
+	root *tree_node
+	cnt  int
+	Cmp  MalType
+	Meta MalType
+}
+
+// NewSortedMap creates an empty map ordered by cmp, or by Compare
+// when cmp is nil
+func NewSortedMap(cmp MalType) SortedMap {
+	return SortedMap{Cmp: cmp}
+}
+
+func SortedMap_Q(obj MalType) bool {
+	_, ok := obj.(SortedMap)
+	return ok
+}
+
+func (m SortedMap) Count() int {
+	return m.cnt
+}
+
+func (m SortedMap) Get(key MalType) (MalType, bool, error) {
+	n := m.root
+	for n != nil {
+		c, e := CompareWith(m.Cmp, key, n.Key)
+		if e != nil {
+			return nil, false, e
+		}
+		if c < 0 {
+			n = n.left
+		} else if c > 0 {
+			n = n.right
+		} else {
+			return n.Val, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (m SortedMap) Assoc(key MalType, val MalType) (SortedMap, error) {
+	root, added, e := tree_insert(m.Cmp, m.root, key, val)
+	if e != nil {
+		return m, e
+	}
+	m.root = root
+	if added {
+		m.cnt += 1
+	}
+	return m, nil
+}
+
+func (m SortedMap) Dissoc(key MalType) (SortedMap, error) {
+	root, removed, e := tree_delete(m.Cmp, m.root, key)
+	if e != nil {
+		return m, e
+	}
+	if removed {
+		m.root = root
+		m.cnt -= 1
+	}
+	return m, nil
+}
+
+// Entries returns the entries in ascending key order
+func (m SortedMap) Entries() []MapEntry {
+	entries := make([]MapEntry, 0, m.cnt)
+	tree_walk(m.Cmp, m.root, nil, false, true, func(ent MapEntry) bool {
+		entries = append(entries, ent)
+		return true
+	})
+	return entries
+}
+
+// Walk visits the entries in order, starting at the first key not
+// before from (in the direction of travel) when has_from is set, until
+// f returns false
+func (m SortedMap) Walk(from MalType, has_from bool, ascending bool,
+	f func(MapEntry) bool) error {
+	_, e := tree_walk(m.Cmp, m.root, from, has_from, ascending, f)
+	return e
+}
+
+// Sorted sets are sorted maps from each element to itself
+type SortedSet struct {
+	sm   SortedMap
+	Meta MalType
+}
+
+func NewSortedSet(cmp MalType) SortedSet {
+	return SortedSet{sm: NewSortedMap(cmp)}
+}
+
+func SortedSet_Q(obj MalType) bool {
+	_, ok := obj.(SortedSet)
+	return ok
+}
+
+func (s SortedSet) Count() int {
+	return s.sm.Count()
+}
+
+func (s SortedSet) Cmp() MalType {
+	return s.sm.Cmp
+}
+
+func (s SortedSet) Get(x MalType) (MalType, bool, error) {
+	return s.sm.Get(x)
+}
+
+func (s SortedSet) Conj(x MalType) (SortedSet, error) {
+	if _, ok, e := s.sm.Get(x); ok || e != nil {
+		return s, e
+	}
+	sm, e := s.sm.Assoc(x, x)
+	s.sm = sm
+	return s, e
+}
+
+func (s SortedSet) Disj(x MalType) (SortedSet, error) {
+	sm, e := s.sm.Dissoc(x)
+	s.sm = sm
+	return s, e
+}
+
+func (s SortedSet) Elements() []MalType {
+	elems := make([]MalType, 0, s.Count())
+	for _, ent := range s.sm.Entries() {
+		elems = append(elems, ent.Key)
+	}
+	return elems
+}
+
+func (s SortedSet) Walk(from MalType, has_from bool, ascending bool,
+	f func(MapEntry) bool) error {
+	return s.sm.Walk(from, has_from, ascending, f)
+}
@@ -0,0 +1,336 @@
+package types
+
+import (
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Software transactional memory: refs keep a short history of
+// committed values, each stamped with the commit point of the global
+// clock that produced it. A transaction reads every ref as of the
+// clock value when it (re)started, so it sees a consistent snapshot,
+// and buffers its writes. At commit the refs it wrote or ensured are
+// locked in id order; if any was committed to after the snapshot the
+// transaction is retried from the start, otherwise its writes get a
+// new commit point. Commutes are re-applied to the latest values at
+// commit time instead, so they never cause a retry.
+
+const ref_max_history = 10
+const stm_retry_limit = 10000
+
+var stm_clock atomic.Uint64
+var ref_ids atomic.Uint64
+
+type ref_version struct {
+	val   MalType
+	point uint64
+}
+
+type Ref struct {
+	id      uint64
+	mu      sync.RWMutex
+	history []ref_version // newest first
+	Meta    MalType
+}
+
+func NewRef(val MalType) *Ref {
+	return &Ref{id: ref_ids.Add(1),
+		history: []ref_version{{val, stm_clock.Load()}}}
+}
+
+func Ref_Q(obj MalType) bool {
+	_, ok := obj.(*Ref)
+	return ok
+}
+
+func (r *Ref) latest() ref_version {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.history[0]
+}
+
+// value as of commit point, false when the history is too short
+func (r *Ref) value_at(point uint64) (MalType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, v := range r.history {
+		if v.point <= point {
+			return v.val, true
+		}
+	}
+	return nil, false
+}
+
+// Transactions
+
+type stm_commute struct {
+	f    MalType
+	args []MalType
+}
+
+type stm_tx struct {
+	read_point uint64
+	vals       map[*Ref]MalType
+	sets       map[*Ref]bool
+	ensures    map[*Ref]bool
+	commutes   map[*Ref][]stm_commute
+	sends      []func() // agent sends, dispatched after commit
+}
+
+// raised with panic to abandon the current attempt, so that a try*
+// in the transaction body cannot swallow it
+type stm_retry struct{}
+
+var stm_txs = map[int64]*stm_tx{}
+var stm_txs_mu sync.Mutex
+
+// the number of transactions running in all goroutines
+var stm_running atomic.Int64
+
+func current_tx() *stm_tx {
+	// finding out the goroutine is slow: only do it when needed
+	if stm_running.Load() == 0 {
+		return nil
+	}
+	stm_txs_mu.Lock()
+	defer stm_txs_mu.Unlock()
+	return stm_txs[goroutine_id()]
+}
+
+// RunInTx runs f in a transaction, retrying it until it commits. A
+// nested call joins the transaction already running.
+func RunInTx(f func() (MalType, error)) (MalType, error) {
+	if current_tx() != nil {
+		return f()
+	}
+	gid := goroutine_id()
+	stm_running.Add(1)
+	defer func() {
+		stm_txs_mu.Lock()
+		delete(stm_txs, gid)
+		stm_txs_mu.Unlock()
+		stm_running.Add(-1)
+	}()
+	for i := 0; i < stm_retry_limit; i++ {
+		tx := &stm_tx{read_point: stm_clock.Load(),
+			vals: map[*Ref]MalType{}, sets: map[*Ref]bool{},
+			ensures: map[*Ref]bool{}, commutes: map[*Ref][]stm_commute{}}
+		stm_txs_mu.Lock()
+		stm_txs[gid] = tx
+		stm_txs_mu.Unlock()
+		res, e, retry := tx.attempt(f)
+		if retry {
+			runtime.Gosched()
+			continue
+		}
+		return res, e
+	}
+	return nil, errors.New("transaction failed after reaching retry limit")
+}
+
+func (tx *stm_tx) attempt(f func() (MalType, error)) (res MalType, e error, retry bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(stm_retry); !ok {
+				panic(r)
+			}
+			retry = true
+		}
+	}()
+	res, e = f()
+	if e != nil {
+		return nil, e, false
+	}
+	if e = tx.commit(); e != nil {
+		return nil, e, false
+	}
+	for _, send := range tx.sends {
+		send()
+	}
+	return res, nil, false
+}
+
+func (tx *stm_tx) get(r *Ref) MalType {
+	if val, ok := tx.vals[r]; ok {
+		return val
+	}
+	val, ok := r.value_at(tx.read_point)
+	if !ok {
+		panic(stm_retry{})
+	}
+	return val
+}
+
+// a ref committed to after the snapshot can't be written by this
+// attempt, so give up early
+func (tx *stm_tx) check_write(r *Ref) {
+	if r.latest().point > tx.read_point {
+		panic(stm_retry{})
+	}
+}
+
+func (tx *stm_tx) commit() error {
+	refs := []*Ref{}
+	for r := range tx.sets {
+		refs = append(refs, r)
+	}
+	for r := range tx.ensures {
+		if !tx.sets[r] {
+			refs = append(refs, r)
+		}
+	}
+	for r := range tx.commutes {
+		if !tx.sets[r] && !tx.ensures[r] {
+			refs = append(refs, r)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].id < refs[j].id })
+	for {
+		vals, bases, e := tx.commute_values(refs)
+		if e != nil {
+			return e
+		}
+		for _, r := range refs {
+			r.mu.Lock()
+		}
+		unlock := func() {
+			for _, r := range refs {
+				r.mu.Unlock()
+			}
+		}
+		for _, r := range refs {
+			if (tx.sets[r] || tx.ensures[r]) && r.history[0].point > tx.read_point {
+				unlock()
+				panic(stm_retry{})
+			}
+		}
+		// a commit to a commuted ref since its commutes ran means
+		// running them again
+		stale := false
+		for r, point := range bases {
+			stale = stale || r.history[0].point != point
+		}
+		if stale {
+			unlock()
+			continue
+		}
+		point := stm_clock.Add(1)
+		for r, val := range vals {
+			history := append([]ref_version{{val, point}}, r.history...)
+			if len(history) > ref_max_history {
+				history = history[:ref_max_history]
+			}
+			r.history = history
+		}
+		unlock()
+		return nil
+	}
+}
+
+// commute_values returns the values to commit to refs, with the
+// commutes re-applied to the latest values, and the commit points of
+// those values. It runs without the refs locked, as the commutes may
+// deref refs.
+func (tx *stm_tx) commute_values(refs []*Ref) (map[*Ref]MalType, map[*Ref]uint64, error) {
+	vals := map[*Ref]MalType{}
+	bases := map[*Ref]uint64{}
+	for _, r := range refs {
+		if tx.sets[r] {
+			vals[r] = tx.vals[r]
+			continue
+		}
+		cs, ok := tx.commutes[r]
+		if !ok {
+			continue
+		}
+		latest := r.latest()
+		val := latest.val
+		for _, c := range cs {
+			var e error
+			val, e = Apply(c.f, append([]MalType{val}, c.args...))
+			if e != nil {
+				return nil, nil, e
+			}
+		}
+		vals[r], bases[r] = val, latest.point
+	}
+	return vals, bases, nil
+}
+
+func get_tx(op string) (*stm_tx, error) {
+	tx := current_tx()
+	if tx == nil {
+		return nil, errors.New(op + ": no transaction running")
+	}
+	return tx, nil
+}
+
+// Ref operations
+
+// Deref returns the in-transaction value, or the latest committed one
+// outside of a transaction
+func (r *Ref) Deref() MalType {
+	if tx := current_tx(); tx != nil {
+		return tx.get(r)
+	}
+	return r.latest().val
+}
+
+func (r *Ref) Set(val MalType) (MalType, error) {
+	tx, e := get_tx("ref-set")
+	if e != nil {
+		return nil, e
+	}
+	if _, ok := tx.commutes[r]; ok && !tx.sets[r] {
+		return nil, errors.New("ref-set: can't set after commute")
+	}
+	tx.check_write(r)
+	tx.vals[r] = val
+	tx.sets[r] = true
+	return val, nil
+}
+
+func (r *Ref) Alter(f MalType, args []MalType) (MalType, error) {
+	tx, e := get_tx("alter")
+	if e != nil {
+		return nil, e
+	}
+	val, e := Apply(f, append([]MalType{tx.get(r)}, args...))
+	if e != nil {
+		return nil, e
+	}
+	return r.Set(val)
+}
+
+// Commute applies f now for the in-transaction value, and again to
+// the latest value at commit time: f should be pure, as it may run
+// more than once
+func (r *Ref) Commute(f MalType, args []MalType) (MalType, error) {
+	tx, e := get_tx("commute")
+	if e != nil {
+		return nil, e
+	}
+	val, e := Apply(f, append([]MalType{tx.get(r)}, args...))
+	if e != nil {
+		return nil, e
+	}
+	tx.vals[r] = val
+	tx.commutes[r] = append(tx.commutes[r], stm_commute{f, args})
+	return val, nil
+}
+
+// Ensure makes the commit fail if r changes before it, although the
+// transaction does not write r
+func (r *Ref) Ensure() (MalType, error) {
+	tx, e := get_tx("ensure")
+	if e != nil {
+		return nil, e
+	}
+	val := tx.get(r)
+	tx.check_write(r)
+	tx.ensures[r] = true
+	return val, nil
+}
@@ -0,0 +1,155 @@
+package types
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func add_fn(a []MalType) (MalType, error) {
+	return a[0].(int) + a[1].(int), nil
+}
+
+var add = Func{add_fn, nil}
+
+func sum_refs(refs []*Ref) int {
+	total := 0
+	for _, r := range refs {
+		total += r.Deref().(int)
+	}
+	return total
+}
+
+// Transfers between random accounts must keep the total constant, and
+// every transaction must see a consistent total while others commit
+func TestTransfers(t *testing.T) {
+	accounts := make([]*Ref, 10)
+	for i := range accounts {
+		accounts[i] = NewRef(100)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				from, to := accounts[rnd.Intn(10)], accounts[rnd.Intn(10)]
+				amount := rnd.Intn(10)
+				_, e := RunInTx(func() (MalType, error) {
+					if _, e := from.Alter(add, []MalType{-amount}); e != nil {
+						return nil, e
+					}
+					return to.Alter(add, []MalType{amount})
+				})
+				if e != nil {
+					errs <- e.Error()
+					return
+				}
+				total, _ := RunInTx(func() (MalType, error) { return sum_refs(accounts), nil })
+				if total != 1000 {
+					errs <- "inconsistent snapshot"
+					return
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Fatal(e)
+	}
+	if total := sum_refs(accounts); total != 1000 {
+		t.Fatalf("total is %d instead of 1000", total)
+	}
+}
+
+func TestCommute(t *testing.T) {
+	counter := NewRef(0)
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				RunInTx(func() (MalType, error) { return counter.Commute(add, []MalType{1}) })
+			}
+		}()
+	}
+	wg.Wait()
+	if counter.Deref() != 5000 {
+		t.Fatalf("counter is %v instead of 5000", counter.Deref())
+	}
+}
+
+// A commute re-applied at commit time may deref a ref locked by the
+// commit, here an ensured one
+func TestCommuteDerefs(t *testing.T) {
+	counter, step := NewRef(0), NewRef(2)
+	add_step := Func{func(a []MalType) (MalType, error) {
+		return a[0].(int) + step.Deref().(int), nil
+	}, nil}
+	done := make(chan MalType)
+	go func() {
+		res, _ := RunInTx(func() (MalType, error) {
+			if _, e := step.Ensure(); e != nil {
+				return nil, e
+			}
+			return counter.Commute(add_step, nil)
+		})
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if res != 2 || counter.Deref() != 2 {
+			t.Fatalf("counter is %v instead of 2", counter.Deref())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit deadlocked")
+	}
+}
+
+// Two transactions each decrement one of two refs if their sum allows
+// it; ensure on the other ref rules out write skew
+func TestEnsure(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		x, y := NewRef(1), NewRef(1)
+		var wg sync.WaitGroup
+		for _, refs := range [][2]*Ref{{x, y}, {y, x}} {
+			wg.Add(1)
+			go func(mine, other *Ref) {
+				defer wg.Done()
+				RunInTx(func() (MalType, error) {
+					o, _ := other.Ensure()
+					if mine.Deref().(int)+o.(int) >= 2 {
+						return mine.Alter(add, []MalType{-1})
+					}
+					return nil, nil
+				})
+			}(refs[0], refs[1])
+		}
+		wg.Wait()
+		if x.Deref().(int)+y.Deref().(int) < 1 {
+			t.Fatal("write skew")
+		}
+	}
+}
+
+func TestNoTransaction(t *testing.T) {
+	r := NewRef(1)
+	if _, e := r.Set(2); e == nil {
+		t.Fatal("ref-set outside of a transaction")
+	}
+	if r.Deref() != 1 {
+		t.Fatal("ref changed outside of a transaction")
+	}
+	_, e := RunInTx(func() (MalType, error) {
+		r.Set(3)
+		return nil, MalError{"abort"}
+	})
+	if e == nil || r.Deref() != 1 {
+		t.Fatal("failed transaction committed")
+	}
+}
@@ -0,0 +1,132 @@
+package types
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timers are backed by Go timers, but their callbacks all run one at a
+// time on a single scheduler goroutine, so they never race with each
+// other. A callback that blocks delays the other timers. A repeating
+// timer that falls behind skips the firings it missed instead of
+// running them in a burst.
+type Timer struct {
+	id        uint64
+	mu        sync.Mutex // guards the fields below
+	timer     *time.Timer
+	next      func(time.Time) (time.Time, bool) // nil for one-shot timers
+	run       func(*Timer)
+	cancelled bool
+	done      bool
+	Meta      MalType
+}
+
+var timer_ids atomic.Uint64
+
+var scheduler_jobs = make(chan func())
+var scheduler_once sync.Once
+
+// a process a callback takes with Self ends with the callback
+func scheduler() {
+	for job := range scheduler_jobs {
+		job()
+		release_self()
+	}
+}
+
+func Timer_Q(obj MalType) bool {
+	_, ok := obj.(*Timer)
+	return ok
+}
+
+// StartTimer calls run at first, then at each time returned by next
+// (given the previous one) until next returns false. next is nil for
+// a timer that fires once.
+func StartTimer(run func(*Timer), first time.Time, next func(time.Time) (time.Time, bool)) *Timer {
+	scheduler_once.Do(func() { go scheduler() })
+	t := &Timer{id: timer_ids.Add(1), run: run, next: next}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.arm(first)
+	return t
+}
+
+// After fires once after d
+func After(d time.Duration, run func(*Timer)) *Timer {
+	return StartTimer(run, time.Now().Add(d), nil)
+}
+
+// Every fires every d, starting after d
+func Every(d time.Duration, run func(*Timer)) *Timer {
+	return StartTimer(run, time.Now().Add(d), func(at time.Time) (time.Time, bool) {
+		return at.Add(d), true
+	})
+}
+
+// called with t.mu held
+func (t *Timer) arm(at time.Time) {
+	t.timer = time.AfterFunc(time.Until(at), func() { t.fire(at) })
+}
+
+// fire rearms or ends the timer before handing its callback to the
+// scheduler, so the callback sees the timer's next state
+func (t *Timer) fire(at time.Time) {
+	if !t.reschedule(at) {
+		return
+	}
+	scheduler_jobs <- func() {
+		t.mu.Lock()
+		cancelled := t.cancelled
+		t.mu.Unlock()
+		if !cancelled {
+			t.run(t)
+		}
+	}
+}
+
+// reschedule arms the next firing after at, or marks the timer done;
+// it returns false if the timer was cancelled
+func (t *Timer) reschedule(at time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancelled {
+		return false
+	}
+	if t.next != nil {
+		now := time.Now()
+		for next, ok := t.next(at); ok; next, ok = t.next(next) {
+			if next.After(now) {
+				t.arm(next)
+				return true
+			}
+		}
+	}
+	t.done = true
+	return true
+}
+
+func (t *Timer) Id() uint64 {
+	return t.id
+}
+
+// Cancel stops the timer, and returns false if it was already done or
+// cancelled. A callback already handed to the scheduler doesn't run.
+func (t *Timer) Cancel() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancelled || t.done {
+		return false
+	}
+	t.cancelled = true
+	t.timer.Stop()
+	return true
+}
+
+// Active is true until the timer is cancelled or has fired for the
+// last time
+func (t *Timer) Active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.cancelled && !t.done
+}
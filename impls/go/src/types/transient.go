@@ -0,0 +1,512 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strconv"
+)
+
+// Transients: a vector, map or set that one goroutine updates in
+// place while building it, then freezes with Persistent. As in
+// Clojure, nodes created or copied by a transient carry its edit
+// token and are mutated directly from then on; nodes without the
+// token are shared with persistent values and are copied first. Once
+// frozen, the token is never used again, so its nodes become as
+// immutable as any other.
+type edit_token struct {
+	_ byte // non-zero size, so that each token has its own address
+}
+
+// goroutine_id parses the id out of "goroutine 123 [running]: ..."
+func goroutine_id() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(buf[:n])
+	id, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+	return id
+}
+
+// Transient vectors: the tail is owned and has room for vec_width
+// elements, so conj appends to it in place
+
+type transient_vector struct {
+	cnt   int
+	shift uint
+	root  *vec_node
+	tail  []MalType
+}
+
+func new_transient_vector(v Vector) *transient_vector {
+	tail := make([]MalType, len(v.tail), vec_width)
+	copy(tail, v.tail)
+	return &transient_vector{v.cnt, v.shift, v.root, tail}
+}
+
+func (tv *transient_vector) vector() Vector {
+	return Vector{cnt: tv.cnt, shift: tv.shift, root: tv.root,
+		tail: tv.tail[:len(tv.tail):len(tv.tail)]}
+}
+
+func editable_vec_node(edit *edit_token, n *vec_node) *vec_node {
+	if n.edit == edit {
+		return n
+	}
+	ret := *n
+	ret.edit = edit
+	return &ret
+}
+
+func (tv *transient_vector) conj(edit *edit_token, val MalType) {
+	if tv.cnt-vec_tailoff(tv.cnt) < vec_width {
+		tv.tail = append(tv.tail, val)
+		tv.cnt += 1
+		return
+	}
+	if tv.root == nil {
+		tv.root = &vec_node{edit: edit}
+		tv.shift = vec_bits
+	}
+	tail_node := &vec_node{edit: edit}
+	copy(tail_node.array[:], tv.tail)
+	if (tv.cnt >> vec_bits) > (1 << tv.shift) {
+		new_root := &vec_node{edit: edit}
+		new_root.array[0] = tv.root
+		new_root.array[1] = new_path(tv.shift, tail_node)
+		tv.root = new_root
+		tv.shift += vec_bits
+	} else {
+		tv.root = tv.push_tail(edit, tv.shift, tv.root, tail_node)
+	}
+	tv.tail = make([]MalType, 1, vec_width)
+	tv.tail[0] = val
+	tv.cnt += 1
+}
+
+func (tv *transient_vector) push_tail(edit *edit_token, level uint, parent *vec_node, tail_node *vec_node) *vec_node {
+	ret := editable_vec_node(edit, parent)
+	subidx := ((tv.cnt - 1) >> level) & vec_mask
+	if level == vec_bits {
+		ret.array[subidx] = tail_node
+	} else if child, ok := ret.array[subidx].(*vec_node); ok {
+		ret.array[subidx] = tv.push_tail(edit, level-vec_bits, child, tail_node)
+	} else {
+		ret.array[subidx] = new_path(level-vec_bits, tail_node)
+	}
+	return ret
+}
+
+func (tv *transient_vector) assoc(edit *edit_token, i int, val MalType) error {
+	if i == tv.cnt {
+		tv.conj(edit, val)
+		return nil
+	}
+	if i < 0 || i > tv.cnt {
+		return errors.New("assoc!: index out of range")
+	}
+	if i >= vec_tailoff(tv.cnt) {
+		tv.tail[i&vec_mask] = val
+		return nil
+	}
+	tv.root = do_assoc_in_place(edit, tv.shift, tv.root, i, val)
+	return nil
+}
+
+func do_assoc_in_place(edit *edit_token, level uint, node *vec_node, i int, val MalType) *vec_node {
+	ret := editable_vec_node(edit, node)
+	if level == 0 {
+		ret.array[i&vec_mask] = val
+	} else {
+		subidx := (i >> level) & vec_mask
+		ret.array[subidx] = do_assoc_in_place(edit, level-vec_bits, ret.array[subidx].(*vec_node), i, val)
+	}
+	return ret
+}
+
+func (tv *transient_vector) pop(edit *edit_token) error {
+	if tv.cnt == 0 {
+		return errors.New("can't pop empty vector")
+	}
+	if tv.cnt == 1 {
+		*tv = transient_vector{tail: make([]MalType, 0, vec_width)}
+		return nil
+	}
+	if tv.cnt-vec_tailoff(tv.cnt) > 1 {
+		tv.tail[len(tv.tail)-1] = nil
+		tv.tail = tv.tail[:len(tv.tail)-1]
+		tv.cnt -= 1
+		return nil
+	}
+	// the tail becomes empty, pull the last leaf out of the tree
+	new_tail := make([]MalType, vec_width)
+	copy(new_tail, tv.vector().array_for(tv.cnt-2))
+	new_root := tv.pop_tail(edit, tv.shift, tv.root)
+	if new_root == nil {
+		new_root = &vec_node{edit: edit}
+	}
+	if tv.shift > vec_bits && new_root.array[1] == nil {
+		new_root = new_root.array[0].(*vec_node)
+		tv.shift -= vec_bits
+	}
+	tv.root = new_root
+	tv.tail = new_tail
+	tv.cnt -= 1
+	return nil
+}
+
+func (tv *transient_vector) pop_tail(edit *edit_token, level uint, node *vec_node) *vec_node {
+	subidx := ((tv.cnt - 2) >> level) & vec_mask
+	if level > vec_bits {
+		new_child := tv.pop_tail(edit, level-vec_bits, node.array[subidx].(*vec_node))
+		if new_child == nil && subidx == 0 {
+			return nil
+		}
+		ret := editable_vec_node(edit, node)
+		if new_child == nil {
+			ret.array[subidx] = nil
+		} else {
+			ret.array[subidx] = new_child
+		}
+		return ret
+	} else if subidx == 0 {
+		return nil
+	}
+	ret := editable_vec_node(edit, node)
+	ret.array[subidx] = nil
+	return ret
+}
+
+// Transient hash maps: owned nodes have their slots inserted and
+// removed in place
+
+type transient_map struct {
+	root *hamt_node
+	cnt  int
+}
+
+func (n *hamt_node) editable(edit *edit_token) *hamt_node {
+	if n.edit == edit {
+		return n
+	}
+	ret := n.clone()
+	ret.edit = edit
+	return ret
+}
+
+func (n *hamt_node) remove_slot(idx int) {
+	copy(n.slots[idx:], n.slots[idx+1:])
+	n.slots[len(n.slots)-1] = hamt_slot{}
+	n.slots = n.slots[:len(n.slots)-1]
+}
+
+func (n *hamt_node) assoc_in_place(edit *edit_token, shift uint, hash uint32, key MalType, val MalType) (*hamt_node, bool) {
+	if n.collision {
+		if hash != n.hash {
+			bit := uint32(1) << ((n.hash >> shift) & hamt_mask)
+			parent := &hamt_node{bitmap: bit, slots: []hamt_slot{{node: n}}, edit: edit}
+			return parent.assoc_in_place(edit, shift, hash, key, val)
+		}
+		ret := n.editable(edit)
+		for i, slot := range ret.slots {
+			if Equal_Q(slot.Key, key) {
+				ret.slots[i].Val = val
+				return ret, false
+			}
+		}
+		ret.slots = append(ret.slots, hamt_slot{MapEntry: MapEntry{key, val}})
+		return ret, true
+	}
+	bit, idx := n.index(shift, hash)
+	ret := n.editable(edit)
+	if n.bitmap&bit == 0 {
+		ret.bitmap |= bit
+		ret.slots = append(ret.slots, hamt_slot{})
+		copy(ret.slots[idx+1:], ret.slots[idx:])
+		ret.slots[idx] = hamt_slot{MapEntry: MapEntry{key, val}}
+		return ret, true
+	}
+	slot := ret.slots[idx]
+	if slot.node != nil {
+		child, added := slot.node.assoc_in_place(edit, shift+hamt_bits, hash, key, val)
+		ret.slots[idx].node = child
+		return ret, added
+	}
+	if Equal_Q(slot.Key, key) {
+		ret.slots[idx].Val = val
+		return ret, false
+	}
+	ret.slots[idx] = hamt_slot{node: new_hamt_pair(shift+hamt_bits,
+		Hash(slot.Key), slot.MapEntry, hash, MapEntry{key, val})}
+	return ret, true
+}
+
+func (n *hamt_node) dissoc_in_place(edit *edit_token, shift uint, hash uint32, key MalType) (*hamt_node, bool) {
+	if n.collision {
+		for i, slot := range n.slots {
+			if Equal_Q(slot.Key, key) {
+				if len(n.slots) == 1 {
+					return nil, true
+				}
+				ret := n.editable(edit)
+				ret.remove_slot(i)
+				return ret, true
+			}
+		}
+		return n, false
+	}
+	bit, idx := n.index(shift, hash)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	slot := n.slots[idx]
+	if slot.node != nil {
+		child, removed := slot.node.dissoc_in_place(edit, shift+hamt_bits, hash, key)
+		if !removed {
+			return n, false
+		}
+		if child != nil {
+			ret := n.editable(edit)
+			if len(child.slots) == 1 && child.slots[0].node == nil {
+				// pull a lone entry up into this node
+				ret.slots[idx] = child.slots[0]
+			} else {
+				ret.slots[idx].node = child
+			}
+			return ret, true
+		}
+	} else if !Equal_Q(slot.Key, key) {
+		return n, false
+	}
+	if len(n.slots) == 1 {
+		return nil, true
+	}
+	ret := n.editable(edit)
+	ret.remove_slot(idx)
+	ret.bitmap &^= bit
+	return ret, true
+}
+
+func (tm *transient_map) get(key MalType) (MalType, bool) {
+	if tm.root == nil {
+		return nil, false
+	}
+	return tm.root.get(0, Hash(key), key)
+}
+
+func (tm *transient_map) assoc(edit *edit_token, key MalType, val MalType) {
+	root := tm.root
+	if root == nil {
+		root = &hamt_node{edit: edit}
+	}
+	root, added := root.assoc_in_place(edit, 0, Hash(key), key, val)
+	tm.root = root
+	if added {
+		tm.cnt += 1
+	}
+}
+
+func (tm *transient_map) dissoc(edit *edit_token, key MalType) {
+	if tm.root == nil {
+		return
+	}
+	root, removed := tm.root.dissoc_in_place(edit, 0, Hash(key), key)
+	if removed {
+		tm.root = root
+		tm.cnt -= 1
+	}
+}
+
+// Transient is the mal-visible transient collection. Array maps are
+// built from a transient index and a transient vector of entries.
+type Transient struct {
+	Kind  string // "vector", "hash-map", "array-map" or "set"
+	edit  *edit_token
+	owner int64
+	vec   *transient_vector
+	hm    *transient_map
+}
+
+func NewTransient(coll MalType) (*Transient, error) {
+	t := &Transient{edit: &edit_token{}, owner: goroutine_id()}
+	switch c := coll.(type) {
+	case Vector:
+		t.Kind, t.vec = "vector", new_transient_vector(c)
+	case HashMap:
+		t.Kind, t.hm = "hash-map", &transient_map{c.root, c.cnt}
+	case ArrayMap:
+		t.Kind, t.hm = "array-map", &transient_map{c.index.root, c.index.cnt}
+		t.vec = new_transient_vector(c.entries)
+	case Set:
+		t.Kind, t.hm = "set", &transient_map{c.hm.root, c.hm.cnt}
+	default:
+		return nil, errors.New("transient not supported on " + TypeName(coll))
+	}
+	return t, nil
+}
+
+func Transient_Q(obj MalType) bool {
+	_, ok := obj.(*Transient)
+	return ok
+}
+
+func (t *Transient) check(op string) error {
+	if t.edit == nil {
+		return errors.New(op + ": transient used after persistent!")
+	}
+	if goroutine_id() != t.owner {
+		return errors.New(op + ": transient used by a goroutine that does not own it")
+	}
+	return nil
+}
+
+func (t *Transient) Count() (int, error) {
+	if e := t.check("count"); e != nil {
+		return 0, e
+	}
+	if t.Kind == "vector" {
+		return t.vec.cnt, nil
+	}
+	return t.hm.cnt, nil
+}
+
+// Get looks up a key, or an index of a vector
+func (t *Transient) Get(key MalType) (MalType, bool, error) {
+	if e := t.check("get"); e != nil {
+		return nil, false, e
+	}
+	switch t.Kind {
+	case "vector":
+		i, ok := key.(int)
+		if !ok {
+			return nil, false, nil
+		}
+		val, ok := t.vec.vector().Nth(i)
+		return val, ok, nil
+	case "array-map":
+		idx, ok := t.hm.get(key)
+		if !ok {
+			return nil, false, nil
+		}
+		ent, _ := t.vec.vector().Nth(idx.(int))
+		return ent.(MapEntry).Val, true, nil
+	default:
+		val, ok := t.hm.get(key)
+		return val, ok, nil
+	}
+}
+
+func (t *Transient) Conj(x MalType) error {
+	if e := t.check("conj!"); e != nil {
+		return e
+	}
+	switch t.Kind {
+	case "vector":
+		t.vec.conj(t.edit, x)
+		return nil
+	case "set":
+		if _, ok := t.hm.get(x); !ok {
+			t.hm.assoc(t.edit, x, x)
+		}
+		return nil
+	default:
+		kv, e := GetSlice(x)
+		if e != nil || len(kv) != 2 {
+			return errors.New("conj! on a map requires [key value] pairs")
+		}
+		return t.assoc(kv[0], kv[1])
+	}
+}
+
+func (t *Transient) Assoc(key MalType, val MalType) error {
+	if e := t.check("assoc!"); e != nil {
+		return e
+	}
+	return t.assoc(key, val)
+}
+
+func (t *Transient) assoc(key MalType, val MalType) error {
+	switch t.Kind {
+	case "vector":
+		i, ok := key.(int)
+		if !ok {
+			return errors.New("assoc! called on vector with non-integer index")
+		}
+		return t.vec.assoc(t.edit, i, val)
+	case "hash-map":
+		t.hm.assoc(t.edit, key, val)
+		return nil
+	case "array-map":
+		if idx, ok := t.hm.get(key); ok {
+			ent, _ := t.vec.vector().Nth(idx.(int))
+			return t.vec.assoc(t.edit, idx.(int), MapEntry{ent.(MapEntry).Key, val})
+		}
+		t.hm.assoc(t.edit, key, t.vec.cnt)
+		t.vec.conj(t.edit, MapEntry{key, val})
+		return nil
+	default:
+		return errors.New("assoc! not supported on transient " + t.Kind)
+	}
+}
+
+func (t *Transient) Dissoc(key MalType) error {
+	if e := t.check("dissoc!"); e != nil {
+		return e
+	}
+	switch t.Kind {
+	case "hash-map":
+		t.hm.dissoc(t.edit, key)
+		return nil
+	case "array-map":
+		if idx, ok := t.hm.get(key); ok {
+			t.hm.dissoc(t.edit, key)
+			return t.vec.assoc(t.edit, idx.(int), nil)
+		}
+		return nil
+	default:
+		return errors.New("dissoc! not supported on transient " + t.Kind)
+	}
+}
+
+func (t *Transient) Disj(x MalType) error {
+	if e := t.check("disj!"); e != nil {
+		return e
+	}
+	if t.Kind != "set" {
+		return errors.New("disj! not supported on transient " + t.Kind)
+	}
+	t.hm.dissoc(t.edit, x)
+	return nil
+}
+
+func (t *Transient) Pop() error {
+	if e := t.check("pop!"); e != nil {
+		return e
+	}
+	if t.Kind != "vector" {
+		return errors.New("pop! not supported on transient " + t.Kind)
+	}
+	return t.vec.pop(t.edit)
+}
+
+// Persistent freezes the transient and returns the collection
+func (t *Transient) Persistent() (MalType, error) {
+	if e := t.check("persistent!"); e != nil {
+		return nil, e
+	}
+	t.edit = nil
+	switch t.Kind {
+	case "vector":
+		return t.vec.vector(), nil
+	case "hash-map":
+		return HashMap{root: t.hm.root, cnt: t.hm.cnt}, nil
+	case "array-map":
+		am := ArrayMap{index: HashMap{root: t.hm.root, cnt: t.hm.cnt},
+			entries: t.vec.vector()}
+		if tombstones := am.entries.Count() - am.Count(); tombstones > am.Count()+8 {
+			return am.compact(), nil
+		}
+		return am, nil
+	default:
+		return Set{hm: HashMap{root: t.hm.root, cnt: t.hm.cnt}}, nil
+	}
+}
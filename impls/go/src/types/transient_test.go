@@ -0,0 +1,96 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTransientBuild(t *testing.T) {
+	tv, _ := NewTransient(Vector{})
+	tm, _ := NewTransient(HashMap{})
+	v, hm := Vector{}, HashMap{}
+	for k := 0; k < 1000; k++ {
+		tv.Conj(k)
+		tm.Assoc(k, k)
+		v, hm = v.Conj(k), hm.Assoc(k, k)
+	}
+	built_v, _ := tv.Persistent()
+	built_hm, _ := tm.Persistent()
+	if !Equal_Q(built_v, v) || !Equal_Q(built_hm, hm) {
+		t.Fatal("transients built other collections than conj and assoc")
+	}
+	if e := tv.Conj(1); e == nil || !strings.Contains(e.Error(), "after persistent!") {
+		t.Fatalf("conj! after persistent!: %v", e)
+	}
+}
+
+func TestTransientOwner(t *testing.T) {
+	tv, _ := NewTransient(Vector{})
+	done := make(chan error)
+	go func() { done <- tv.Conj(1) }()
+	if e := <-done; e == nil || !strings.Contains(e.Error(), "does not own it") {
+		t.Fatalf("conj! from another goroutine: %v", e)
+	}
+	if e := tv.Conj(1); e != nil {
+		t.Fatal(e)
+	}
+	tm, _ := NewTransient(ArrayMap{})
+	if e := tm.Conj(NewVector(1, 2)); e != nil {
+		t.Fatalf("conj! of an entry: %v", e)
+	}
+}
+
+func BenchmarkConjPersistent(b *testing.B) {
+	for _, n := range sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				v := Vector{}
+				for k := 0; k < n; k++ {
+					v = v.Conj(k)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConjTransient(b *testing.B) {
+	for _, n := range sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				t, _ := NewTransient(Vector{})
+				for k := 0; k < n; k++ {
+					t.Conj(k)
+				}
+				t.Persistent()
+			}
+		})
+	}
+}
+
+func BenchmarkAssocPersistent(b *testing.B) {
+	for _, n := range sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hm := HashMap{}
+				for k := 0; k < n; k++ {
+					hm = hm.Assoc(k, k)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAssocTransient(b *testing.B) {
+	for _, n := range sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				t, _ := NewTransient(HashMap{})
+				for k := 0; k < n; k++ {
+					t.Assoc(k, k)
+				}
+				t.Persistent()
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"unsafe"
 )
 
 // Errors/Exceptions
@@ -12,18 +13,31 @@ type MalError struct {
 	Obj MalType
 }
 
+// PrintError prints the value of a MalError; the printer replaces it
+// to print the value as mal does
+var PrintError = func(obj MalType) string {
+	return fmt.Sprintf("%#v", obj)
+}
+
 func (e MalError) Error() string {
-	return fmt.Sprintf("%#v", e.Obj)
+	return PrintError(e.Obj)
 }
 
 // General types
 type MalType interface {
 }
 
+// Environments: Lookup, Find and Get search the environment and then
+// its outer environments, through this interface only, so that other
+// implementations (read-only, layered, backed by a store...) can be
+// mixed with env.Env. Set defines the symbol in the environment itself.
+// Outer is nil for the root environment.
 type EnvType interface {
+	Lookup(key Symbol) (MalType, bool)
 	Find(key Symbol) EnvType
 	Set(key Symbol, value MalType) MalType
 	Get(key Symbol) (MalType, error)
+	Outer() EnvType
 }
 
 // Scalars
@@ -48,7 +62,8 @@ func Number_Q(obj MalType) bool {
 
 // Symbols
 type Symbol struct {
-	Val string
+	Val  string
+	Meta MalType
 }
 
 func Symbol_Q(obj MalType) bool {
@@ -121,6 +136,8 @@ func Apply(f_mt MalType, a []MalType) (MalType, error) {
 		return f.Fn(a)
 	case func([]MalType) (MalType, error):
 		return f(a)
+	case *MultiFn:
+		return f.Fn(a)
 	default:
 		return nil, errors.New("Invalid function to Apply")
 	}
@@ -141,95 +158,156 @@ func List_Q(obj MalType) bool {
 	return ok
 }
 
-// Vectors
-type Vector struct {
-	Val  []MalType
-	Meta MalType
-}
-
-func Vector_Q(obj MalType) bool {
-	_, ok := obj.(Vector)
-	return ok
-}
-
 func GetSlice(seq MalType) ([]MalType, error) {
 	switch obj := seq.(type) {
 	case List:
 		return obj.Val, nil
 	case Vector:
-		return obj.Val, nil
+		return obj.Slice(), nil
+	case Set:
+		return obj.Elements(), nil
+	case SortedSet:
+		return obj.Elements(), nil
+	case LazySeq:
+		return lazy_slice(obj)
 	default:
 		return nil, errors.New("GetSlice called on non-sequence")
 	}
 }
 
-// Hash Maps
-type HashMap struct {
-	Val  map[string]MalType
-	Meta MalType
-}
+// General functions
 
-func NewHashMap(seq MalType) (MalType, error) {
-	lst, e := GetSlice(seq)
-	if e != nil {
-		return nil, e
-	}
-	if len(lst)%2 == 1 {
-		return nil, errors.New("Odd number of arguments to NewHashMap")
+func _obj_type(obj MalType) string {
+	if obj == nil {
+		return "nil"
 	}
-	m := map[string]MalType{}
-	for i := 0; i < len(lst); i += 2 {
-		str, ok := lst[i].(string)
-		if !ok {
-			return nil, errors.New("expected hash-map key string")
+	return reflect.TypeOf(obj).Name()
+}
+
+// TypeName names the type of a value as seen from mal: the name of
+// a record type, or the name of the built-in type
+func TypeName(obj MalType) string {
+	switch tobj := obj.(type) {
+	case nil:
+		return "Nil"
+	case bool:
+		return "Boolean"
+	case int:
+		return "Number"
+	case string:
+		if Keyword_Q(tobj) {
+			return "Keyword"
 		}
-		m[str] = lst[i+1]
+		return "String"
+	case Func, MalFunc:
+		return "Function"
+	case *Atom:
+		return "Atom"
+	case *Ref:
+		return "Ref"
+	case *Agent:
+		return "Agent"
+	case *Future:
+		return "Future"
+	case *Promise:
+		return "Promise"
+	case *Delay:
+		return "Delay"
+	case *Chan:
+		return "Channel"
+	case *Process:
+		return "Process"
+	case *Timer:
+		return "Timer"
+	case EnvType:
+		return "Environment"
+	case Record:
+		return tobj.Type.Name
+	case ArrayMap:
+		// map literals are small ordered maps, but are hash maps as
+		// far as mal is concerned
+		return "HashMap"
+	default:
+		return _obj_type(obj)
 	}
-	return HashMap{m, nil}, nil
 }
 
-func HashMap_Q(obj MalType) bool {
-	_, ok := obj.(HashMap)
-	return ok
+func Sequential_Q(seq MalType) bool {
+	if seq == nil {
+		return false
+	}
+	return (reflect.TypeOf(seq).Name() == "List") ||
+		(reflect.TypeOf(seq).Name() == "Vector") ||
+		(reflect.TypeOf(seq).Name() == "LazySeq")
 }
 
-// Atoms
-type Atom struct {
-	Val  MalType
-	Meta MalType
-}
+// Hash, array and sorted maps, and hash and sorted sets, are
+// interchangeable wherever only their contents matter
 
-func (a *Atom) Set(val MalType) MalType {
-	a.Val = val
-	return a
+func Map_Q(obj MalType) bool {
+	switch obj.(type) {
+	case HashMap, ArrayMap, SortedMap:
+		return true
+	}
+	return false
 }
 
-func Atom_Q(obj MalType) bool {
-	_, ok := obj.(*Atom)
-	return ok
+func SetLike_Q(obj MalType) bool {
+	switch obj.(type) {
+	case Set, SortedSet:
+		return true
+	}
+	return false
 }
 
-// General functions
+func MapEntries(obj MalType) ([]MapEntry, error) {
+	switch m := obj.(type) {
+	case HashMap:
+		return m.Entries(), nil
+	case ArrayMap:
+		return m.Entries(), nil
+	case SortedMap:
+		return m.Entries(), nil
+	case Record:
+		return m.Entries(), nil
+	}
+	return nil, errors.New("MapEntries called on non-map")
+}
 
-func _obj_type(obj MalType) string {
-	if obj == nil {
-		return "nil"
+func MapGet(obj MalType, key MalType) (MalType, bool, error) {
+	switch m := obj.(type) {
+	case HashMap:
+		val, ok := m.Get(key)
+		return val, ok, nil
+	case ArrayMap:
+		val, ok := m.Get(key)
+		return val, ok, nil
+	case SortedMap:
+		return m.Get(key)
+	case Record:
+		val, ok := m.Get(key)
+		return val, ok, nil
 	}
-	return reflect.TypeOf(obj).Name()
+	return nil, false, errors.New("MapGet called on non-map")
 }
 
-func Sequential_Q(seq MalType) bool {
-	if seq == nil {
-		return false
+// SetGet returns the element of the set equal to x
+func SetGet(obj MalType, x MalType) (MalType, bool, error) {
+	switch s := obj.(type) {
+	case Set:
+		elem, ok := s.Get(x)
+		return elem, ok, nil
+	case SortedSet:
+		return s.Get(x)
 	}
-	return (reflect.TypeOf(seq).Name() == "List") ||
-		(reflect.TypeOf(seq).Name() == "Vector")
+	return nil, false, errors.New("SetGet called on non-set")
 }
 
 func Equal_Q(a MalType, b MalType) bool {
 	ota := reflect.TypeOf(a)
 	otb := reflect.TypeOf(b)
-	if !((ota == otb) || (Sequential_Q(a) && Sequential_Q(b))) {
+	if !((ota == otb) || (Sequential_Q(a) && Sequential_Q(b)) ||
+		(Map_Q(a) && Map_Q(b)) || (SetLike_Q(a) && SetLike_Q(b))) {
 		return false
 	}
 	//av := reflect.ValueOf(a); bv := reflect.ValueOf(b)
@@ -238,7 +316,7 @@ func Equal_Q(a MalType, b MalType) bool {
 	switch a.(type) {
 	case Symbol:
 		return a.(Symbol).Val == b.(Symbol).Val
-	case List:
+	case List, LazySeq:
 		as, _ := GetSlice(a)
 		bs, _ := GetSlice(b)
 		if len(as) != len(bs) {
@@ -262,19 +340,220 @@ func Equal_Q(a MalType, b MalType) bool {
 			}
 		}
 		return true
-	case HashMap:
-		am := a.(HashMap).Val
-		bm := b.(HashMap).Val
-		if len(am) != len(bm) {
+	case HashMap, ArrayMap, SortedMap:
+		as, _ := MapEntries(a)
+		bs, _ := MapEntries(b)
+		if len(as) != len(bs) {
+			return false
+		}
+		for _, ent := range as {
+			bv, ok, e := MapGet(b, ent.Key)
+			if e != nil || !ok || !Equal_Q(ent.Val, bv) {
+				return false
+			}
+		}
+		return true
+	case Set, SortedSet:
+		as, _ := GetSlice(a)
+		bs, _ := GetSlice(b)
+		if len(as) != len(bs) {
 			return false
 		}
-		for k, v := range am {
-			if !Equal_Q(v, bm[k]) {
+		for _, x := range as {
+			if _, ok, e := SetGet(b, x); e != nil || !ok {
 				return false
 			}
 		}
 		return true
+	case Record:
+		ar := a.(Record)
+		br := b.(Record)
+		if ar.Type != br.Type || ar.Count() != br.Count() {
+			return false
+		}
+		for _, ent := range ar.Entries() {
+			bv, ok := br.Get(ent.Key)
+			if !ok || !Equal_Q(ent.Val, bv) {
+				return false
+			}
+		}
+		return true
+	case Func:
+		return same_ref(a.(Func).Fn, b.(Func).Fn)
+	case func([]MalType) (MalType, error):
+		return same_ref(a, b)
+	case MalFunc:
+		af, bf := a.(MalFunc), b.(MalFunc)
+		return same_ref(af.Exp, bf.Exp) && same_ref(af.Env, bf.Env) &&
+			af.IsMacro == bf.IsMacro
 	default:
 		return a == b
 	}
 }
+
+// same_ref compares by identity values that can't be compared with ==
+// (functions, slices, maps), like Hash does
+func same_ref(a MalType, b MalType) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	if al, ok := a.(List); ok {
+		bl := b.(List)
+		return len(al.Val) == len(bl.Val) &&
+			(len(al.Val) == 0 || &al.Val[0] == &bl.Val[0])
+	}
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch av.Kind() {
+	case reflect.Func:
+		// Pointer gives the code of a closure, shared by all the
+		// closures made from one function literal, so compare the
+		// closures themselves: the data words of the interfaces
+		return (*[2]unsafe.Pointer)(unsafe.Pointer(&a))[1] ==
+			(*[2]unsafe.Pointer)(unsafe.Pointer(&b))[1]
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Chan:
+		return av.Pointer() == bv.Pointer()
+	}
+	if !av.Type().Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// Identical is true when a and b are the same value rather than equal
+// ones: scalars compare with ==, collections and other references by
+// the storage they point to, and functions as in Equal_Q. Two
+// collections built apart are never identical, even when equal.
+func Identical(a MalType, b MalType) bool {
+	switch a.(type) {
+	case Func, func([]MalType) (MalType, error), MalFunc:
+		return Equal_Q(a, b)
+	}
+	return identical(reflect.ValueOf(&a).Elem(), reflect.ValueOf(&b).Elem())
+}
+
+func identical(a reflect.Value, b reflect.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() && b.IsNil()
+		}
+		return identical(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !identical(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if !identical(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		return a.Len() == b.Len() && a.Pointer() == b.Pointer()
+	case reflect.Map, reflect.Ptr, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+	case reflect.String:
+		return a.String() == b.String()
+	}
+	return false
+}
+
+// Hashing
+
+// Hash is consistent with Equal_Q: values that are equal hash the
+// same, so lists and vectors with equal elements collide
+func Hash(obj MalType) uint32 {
+	switch tobj := obj.(type) {
+	case nil:
+		return 0
+	case bool:
+		if tobj {
+			return 1231
+		}
+		return 1237
+	case int:
+		return mix_hash(uint64(tobj))
+	case string:
+		return hash_string(2166136261, tobj)
+	case Symbol:
+		return hash_string(0x9e3779b9, tobj.Val)
+	case List, Vector, LazySeq:
+		slc, _ := GetSlice(obj)
+		var h uint32 = 1
+		for _, e := range slc {
+			h = 31*h + Hash(e)
+		}
+		return mix_hash(uint64(h))
+	case HashMap, ArrayMap, SortedMap:
+		// order independent
+		entries, _ := MapEntries(obj)
+		var h uint32 = 0
+		for _, ent := range entries {
+			h += Hash(ent.Key) ^ Hash(ent.Val)
+		}
+		return mix_hash(uint64(h))
+	case Set, SortedSet:
+		elems, _ := GetSlice(obj)
+		var h uint32 = 0
+		for _, x := range elems {
+			h += Hash(x)
+		}
+		return mix_hash(uint64(h) + 1)
+	case Record:
+		h := hash_string(2166136261, tobj.Type.Name)
+		for _, ent := range tobj.Entries() {
+			h += Hash(ent.Key) ^ Hash(ent.Val)
+		}
+		return mix_hash(uint64(h))
+	case Func:
+		return mix_hash(uint64(reflect.ValueOf(tobj.Fn).Pointer()))
+	case MalFunc:
+		return 31*Hash(tobj.Params) + Hash(tobj.Exp)
+	default:
+		v := reflect.ValueOf(obj)
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Func, reflect.Chan, reflect.Map:
+			return mix_hash(uint64(v.Pointer()))
+		}
+		return hash_string(2166136261, _obj_type(obj))
+	}
+}
+
+// FNV-1a
+func hash_string(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// finalizer from MurmurHash3
+func mix_hash(k uint64) uint32 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return uint32(k)
+}
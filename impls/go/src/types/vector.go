@@ -0,0 +1,260 @@
+package types
+
+import (
+	"errors"
+)
+
+// Persistent vector: a bit-partitioned trie of 32-way nodes plus a
+// tail holding the last (up to 32) elements, as in Clojure. Updates
+// copy only the path from the root to the changed leaf, so every
+// version stays valid and nth/conj/assoc/pop are O(log32 n).
+
+const vec_bits = 5
+const vec_width = 1 << vec_bits
+const vec_mask = vec_width - 1
+
+// Branch nodes hold *vec_node children, leaf nodes hold the values.
+// Nodes owned by a transient carry its edit token (see transient.go).
+type vec_node struct {
+	array [vec_width]MalType
+	edit  *edit_token
+}
+
+type Vector struct {
+	cnt   int
+	shift uint
+	root  *vec_node
+	tail  []MalType
+	Meta  MalType
+}
+
+func NewVector(a ...MalType) MalType {
+	vec := Vector{}
+	if len(a) <= vec_width {
+		vec.cnt = len(a)
+		vec.tail = append([]MalType{}, a...)
+		return vec
+	}
+	return vec.Conj(a...)
+}
+
+func Vector_Q(obj MalType) bool {
+	_, ok := obj.(Vector)
+	return ok
+}
+
+func (v Vector) Count() int {
+	return v.cnt
+}
+
+// index of the first element stored in the tail
+func (v Vector) tailoff() int {
+	return vec_tailoff(v.cnt)
+}
+
+func vec_tailoff(cnt int) int {
+	if cnt < vec_width {
+		return 0
+	}
+	return ((cnt - 1) >> vec_bits) << vec_bits
+}
+
+// leaf array holding element i
+func (v Vector) array_for(i int) []MalType {
+	if i >= v.tailoff() {
+		return v.tail
+	}
+	node := v.root
+	for level := v.shift; level > 0; level -= vec_bits {
+		node = node.array[(i>>level)&vec_mask].(*vec_node)
+	}
+	return node.array[:]
+}
+
+func (v Vector) Nth(i int) (MalType, bool) {
+	if i < 0 || i >= v.cnt {
+		return nil, false
+	}
+	return v.array_for(i)[i&vec_mask], true
+}
+
+// Slice copies the elements into a new Go slice
+func (v Vector) Slice() []MalType {
+	slc := make([]MalType, 0, v.cnt)
+	for i := 0; i < v.cnt; i += vec_width {
+		arr := v.array_for(i)
+		if v.cnt-i < vec_width {
+			arr = arr[:v.cnt-i]
+		}
+		slc = append(slc, arr...)
+	}
+	return slc
+}
+
+// SeqFrom returns the elements from index i on without copying them:
+// a list over the leaf holding them if they all are in one, otherwise
+// a lazy sequence walking the leaves
+func (v Vector) SeqFrom(i int) MalType {
+	if i >= v.cnt {
+		return List{}
+	}
+	end := min(v.cnt-(i&^vec_mask), vec_width)
+	chunk := v.array_for(i)[i&vec_mask : end : end]
+	next := i + len(chunk)
+	if next >= v.cnt {
+		return List{chunk, nil}
+	}
+	return NewLazySeq(func() (MalType, error) {
+		seq := v.SeqFrom(next)
+		for j := len(chunk) - 1; j >= 0; j-- {
+			seq = NewCons(chunk[j], seq)
+		}
+		return seq, nil
+	})
+}
+
+func (v Vector) Conj(vals ...MalType) Vector {
+	for _, val := range vals {
+		v = v.conj1(val)
+	}
+	return v
+}
+
+func (v Vector) conj1(val MalType) Vector {
+	// room in the tail
+	if v.cnt-v.tailoff() < vec_width {
+		new_tail := make([]MalType, len(v.tail)+1)
+		copy(new_tail, v.tail)
+		new_tail[len(v.tail)] = val
+		v.tail = new_tail
+		v.cnt += 1
+		return v
+	}
+	// full tail, push it into the tree
+	if v.root == nil {
+		v.root = &vec_node{}
+		v.shift = vec_bits
+	}
+	tail_node := &vec_node{}
+	copy(tail_node.array[:], v.tail)
+	if (v.cnt >> vec_bits) > (1 << v.shift) {
+		// root overflow
+		new_root := &vec_node{}
+		new_root.array[0] = v.root
+		new_root.array[1] = new_path(v.shift, tail_node)
+		v.root = new_root
+		v.shift += vec_bits
+	} else {
+		v.root = v.push_tail(v.shift, v.root, tail_node)
+	}
+	v.tail = []MalType{val}
+	v.cnt += 1
+	return v
+}
+
+func (v Vector) push_tail(level uint, parent *vec_node, tail_node *vec_node) *vec_node {
+	subidx := ((v.cnt - 1) >> level) & vec_mask
+	ret := *parent
+	var to_insert *vec_node
+	if level == vec_bits {
+		to_insert = tail_node
+	} else if child, ok := parent.array[subidx].(*vec_node); ok {
+		to_insert = v.push_tail(level-vec_bits, child, tail_node)
+	} else {
+		to_insert = new_path(level-vec_bits, tail_node)
+	}
+	ret.array[subidx] = to_insert
+	return &ret
+}
+
+func new_path(level uint, node *vec_node) *vec_node {
+	if level == 0 {
+		return node
+	}
+	ret := &vec_node{}
+	ret.array[0] = new_path(level-vec_bits, node)
+	return ret
+}
+
+// AssocN replaces element i, or appends when i is the count
+func (v Vector) AssocN(i int, val MalType) (Vector, error) {
+	if i == v.cnt {
+		return v.conj1(val), nil
+	}
+	if i < 0 || i > v.cnt {
+		return v, errors.New("assoc: index out of range")
+	}
+	if i >= v.tailoff() {
+		new_tail := make([]MalType, len(v.tail))
+		copy(new_tail, v.tail)
+		new_tail[i&vec_mask] = val
+		v.tail = new_tail
+		return v, nil
+	}
+	v.root = do_assoc(v.shift, v.root, i, val)
+	return v, nil
+}
+
+func do_assoc(level uint, node *vec_node, i int, val MalType) *vec_node {
+	ret := *node
+	if level == 0 {
+		ret.array[i&vec_mask] = val
+	} else {
+		subidx := (i >> level) & vec_mask
+		ret.array[subidx] = do_assoc(level-vec_bits, node.array[subidx].(*vec_node), i, val)
+	}
+	return &ret
+}
+
+// Pop removes the last element
+func (v Vector) Pop() (Vector, error) {
+	if v.cnt == 0 {
+		return v, errors.New("can't pop empty vector")
+	}
+	if v.cnt == 1 {
+		return Vector{Meta: v.Meta}, nil
+	}
+	if v.cnt-v.tailoff() > 1 {
+		v.tail = v.tail[: len(v.tail)-1 : len(v.tail)-1]
+		v.cnt -= 1
+		return v, nil
+	}
+	// the tail becomes empty, pull the last leaf out of the tree
+	new_tail := v.array_for(v.cnt - 2)
+	new_root := v.pop_tail(v.shift, v.root)
+	new_shift := v.shift
+	if new_root == nil {
+		new_root = &vec_node{}
+	}
+	if v.shift > vec_bits && new_root.array[1] == nil {
+		new_root = new_root.array[0].(*vec_node)
+		new_shift -= vec_bits
+	}
+	v.root = new_root
+	v.shift = new_shift
+	v.tail = new_tail[:vec_width:vec_width]
+	v.cnt -= 1
+	return v, nil
+}
+
+func (v Vector) pop_tail(level uint, node *vec_node) *vec_node {
+	subidx := ((v.cnt - 2) >> level) & vec_mask
+	if level > vec_bits {
+		new_child := v.pop_tail(level-vec_bits, node.array[subidx].(*vec_node))
+		if new_child == nil && subidx == 0 {
+			return nil
+		}
+		ret := *node
+		if new_child == nil {
+			ret.array[subidx] = nil
+		} else {
+			ret.array[subidx] = new_child
+		}
+		return &ret
+	} else if subidx == 0 {
+		return nil
+	}
+	ret := *node
+	ret.array[subidx] = nil
+	return &ret
+}
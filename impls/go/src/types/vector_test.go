@@ -0,0 +1,141 @@
+package types
+
+import (
+	"testing"
+)
+
+// sizes around the boundaries of the tail and of the levels of the
+// trie: 32 elements fill the tail, 32+32*32 a root of leaves, and
+// 32+32*32*32 a root of branches
+var vector_sizes = []int{0, 1, 31, 32, 33, 63, 64, 65, 1055, 1056, 1057, 1088, 32800, 32801}
+
+func check_vector(t *testing.T, v Vector, n int, at func(int) int) {
+	t.Helper()
+	if v.Count() != n {
+		t.Fatalf("count is %d instead of %d", v.Count(), n)
+	}
+	for i := 0; i < n; i++ {
+		if x, ok := v.Nth(i); !ok || x != at(i) {
+			t.Fatalf("element %d of %d is %v", i, n, x)
+		}
+	}
+	if _, ok := v.Nth(n); ok {
+		t.Fatalf("element %d of %d found", n, n)
+	}
+	slc := v.Slice()
+	if len(slc) != n {
+		t.Fatalf("slice of %d elements instead of %d", len(slc), n)
+	}
+	for i, x := range slc {
+		if x != at(i) {
+			t.Fatalf("slice element %d of %d is %v", i, n, x)
+		}
+	}
+}
+
+func identity(i int) int { return i }
+
+func TestVectorConjPop(t *testing.T) {
+	max_size := vector_sizes[len(vector_sizes)-1]
+	versions := make([]Vector, max_size+1)
+	v := Vector{}
+	for i := 0; i <= max_size; i++ {
+		versions[i] = v
+		v = v.Conj(i)
+	}
+	for _, n := range vector_sizes {
+		check_vector(t, versions[n], n, identity)
+	}
+	// popping back across the same boundaries
+	for n := max_size + 1; n > 0; n-- {
+		var e error
+		if v, e = v.Pop(); e != nil {
+			t.Fatal(e)
+		}
+		for _, size := range vector_sizes {
+			if n-1 == size {
+				check_vector(t, v, size, identity)
+			}
+		}
+	}
+	if _, e := v.Pop(); e == nil {
+		t.Fatal("popped an empty vector")
+	}
+	// pushing onto a popped version leaves the original alone
+	for _, n := range vector_sizes {
+		if n == 0 {
+			continue
+		}
+		popped, _ := versions[n].Pop()
+		pushed := popped.Conj(-1)
+		check_vector(t, versions[n], n, identity)
+		check_vector(t, pushed, n, func(i int) int {
+			if i == n-1 {
+				return -1
+			}
+			return i
+		})
+	}
+}
+
+func TestVectorAssocShared(t *testing.T) {
+	for _, n := range vector_sizes {
+		if n == 0 {
+			continue
+		}
+		v := Vector{}
+		for i := 0; i < n; i++ {
+			v = v.Conj(i)
+		}
+		// update the first, middle and last elements of one version
+		// in two different ways
+		a, b := v, v
+		for _, i := range []int{0, n / 2, n - 1} {
+			a, _ = a.AssocN(i, -i-1)
+			b, _ = b.AssocN(i, -i-2)
+		}
+		changed := func(delta int) func(int) int {
+			return func(i int) int {
+				if i == 0 || i == n/2 || i == n-1 {
+					return -i - delta
+				}
+				return i
+			}
+		}
+		check_vector(t, v, n, identity)
+		check_vector(t, a, n, changed(1))
+		check_vector(t, b, n, changed(2))
+		if grown, e := v.AssocN(n, n); e != nil || grown.Count() != n+1 {
+			t.Fatalf("assoc at the end of %d elements: %v", n, e)
+		}
+		if _, e := v.AssocN(n+1, 0); e == nil {
+			t.Fatalf("assoc past the end of %d elements", n)
+		}
+	}
+}
+
+func TestVectorSeqFrom(t *testing.T) {
+	for _, n := range vector_sizes {
+		v := Vector{}
+		for i := 0; i < n; i++ {
+			v = v.Conj(i)
+		}
+		for _, from := range []int{0, 1, 31, 32, 33, n - 1, n, n + 1} {
+			if from < 0 {
+				continue
+			}
+			slc, e := GetSlice(v.SeqFrom(from))
+			if e != nil {
+				t.Fatal(e)
+			}
+			if want := max(n-from, 0); len(slc) != want {
+				t.Fatalf("%d elements from %d of %d instead of %d", len(slc), from, n, want)
+			}
+			for i, x := range slc {
+				if x != from+i {
+					t.Fatalf("element %d from %d of %d is %v", i, from, n, x)
+				}
+			}
+		}
+	}
+}